@@ -1,12 +1,20 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"errors"
 	"io"
+	"sort"
 )
 
-// ErrUnSupportedMethod returns when method has not been supported.
-var ErrUnSupportedMethod = errors.New("unsupported authentication method")
+var (
+	// ErrUnSupportedMethod returns when method has not been supported.
+	ErrUnSupportedMethod = errors.New("unsupported authentication method")
+
+	// ErrAuthenticationFailed returns when the peer could not be authenticated.
+	ErrAuthenticationFailed = errors.New("authentication failed")
+)
 
 // Method represents auth method.
 type Method byte
@@ -26,6 +34,15 @@ const (
 	// X'03' to X'7F' IANA ASSIGNED
 	// X'80' to X'FE' RESERVED FOR PRIVATE METHODS
 
+	// MethodHMACSHA256 represents challenge-response by HMAC-SHA256 with
+	// the shared key. This is a private method of this package, so the
+	// password is not sent on the wire.
+	MethodHMACSHA256 Method = 0x80
+
+	// MethodJWT represents bearer authentication by JSON Web Token.
+	// This is a private method of this package.
+	MethodJWT Method = 0x81
+
 	// MethodNoAcceptableMethods represents no acceptable authentication methods.
 	MethodNoAcceptableMethods Method = 0xff
 )
@@ -33,3 +50,107 @@ const (
 type Authenticator interface {
 	Authenticate(conn io.ReadWriter) error
 }
+
+// MethodOrder returns the methods of authenticators in the order of
+// preference. The methods in order come first, and the others follow
+// in ascending order of their values.
+func MethodOrder(order []Method, authenticators map[Method]Authenticator) []Method {
+	ordered := make([]Method, 0, len(authenticators))
+	seen := make(map[Method]bool, len(authenticators))
+	for _, m := range order {
+		if _, ok := authenticators[m]; ok && !seen[m] {
+			ordered = append(ordered, m)
+			seen[m] = true
+		}
+	}
+	rest := make([]Method, 0, len(authenticators)-len(ordered))
+	for m := range authenticators {
+		if !seen[m] {
+			rest = append(rest, m)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i] < rest[j] })
+	return append(ordered, rest...)
+}
+
+// UsernamePasswordVersion is the version of the username/password
+// sub-negotiation.
+// See: https://tools.ietf.org/html/rfc1929
+const UsernamePasswordVersion = 0x01
+
+// A CredentialStore validates username/password pairs.
+type CredentialStore interface {
+	Valid(username, password string) bool
+}
+
+// The CredentialStoreFunc type is an adapter to allow the use of
+// ordinary functions as CredentialStore.
+type CredentialStoreFunc func(username, password string) bool
+
+// Valid calls f(username, password).
+func (f CredentialStoreFunc) Valid(username, password string) bool {
+	return f(username, password)
+}
+
+// HMACSHA256Version is the version of the HMAC-SHA256 sub-negotiation.
+//
+// The server sends the nonce:
+//
+//	+----+----------+
+//	|VER |  NONCE   |
+//	+----+----------+
+//	| 1  |    32    |
+//	+----+----------+
+//
+// The client answers with its own nonce and HMAC-SHA256(key, NONCE ||
+// CNONCE || UNAME):
+//
+//	+----+------+----------+----------+----------+
+//	|VER | ULEN |  UNAME   |  CNONCE  |   MAC    |
+//	+----+------+----------+----------+----------+
+//	| 1  |  1   | 1 to 255 |    32    |    32    |
+//	+----+------+----------+----------+----------+
+//
+// The server replies VER and STATUS as username/password, X'00'
+// indicates success.
+const HMACSHA256Version = 0x01
+
+// HMACSHA256NonceSize is the size of the nonces of HMAC-SHA256 method.
+const HMACSHA256NonceSize = 32
+
+// HMACSHA256 returns the MAC of the HMAC-SHA256 method.
+func HMACSHA256(key, nonce, cnonce []byte, username string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	mac.Write(cnonce)
+	mac.Write([]byte(username))
+	return mac.Sum(nil)
+}
+
+// A KeyStore looks up the shared keys of users for HMAC-SHA256 method.
+type KeyStore interface {
+	Key(username string) (key []byte, ok bool)
+}
+
+// The KeyStoreFunc type is an adapter to allow the use of ordinary
+// functions as KeyStore.
+type KeyStoreFunc func(username string) ([]byte, bool)
+
+// Key calls f(username).
+func (f KeyStoreFunc) Key(username string) ([]byte, bool) {
+	return f(username)
+}
+
+// JWTVersion is the version of the JWT sub-negotiation.
+//
+// The client sends the token:
+//
+//	+----+------+----------+
+//	|VER | TLEN |  TOKEN   |
+//	+----+------+----------+
+//	| 1  |  2   | Variable |
+//	+----+------+----------+
+//
+// TLEN is in network octet order. The server replies VER and STATUS as
+// username/password, X'00' indicates success.
+const JWTVersion = 0x01
@@ -0,0 +1,70 @@
+package auth
+
+import "net"
+
+// GSSAPIVersion is the version of the GSS-API sub-negotiation.
+// See: https://tools.ietf.org/html/rfc1961
+//
+//	+------+------+------+.......................+
+//	+ ver  | mtyp | len  |       token           |
+//	+------+------+------+.......................+
+//	+ 0x01 | 0x01 | 0x02 | up to 2^16 - 1 octets |
+//	+------+------+------+.......................+
+const GSSAPIVersion = 0x01
+
+// The message types of the GSS-API sub-negotiation.
+const (
+	GSSAPIAuthentication byte = 0x01
+	GSSAPIProtection     byte = 0x02
+	GSSAPIEncapsulation  byte = 0x03
+	GSSAPIAbort          byte = 0xff
+)
+
+// GSSProtectionLevel is the per-message protection negotiated by GSS-API.
+type GSSProtectionLevel byte
+
+const (
+	// GSSIntegrity protects the integrity of the messages.
+	GSSIntegrity GSSProtectionLevel = 1
+	// GSSConfidentiality protects the integrity and the confidentiality
+	// of the messages.
+	GSSConfidentiality GSSProtectionLevel = 2
+	// GSSSelective lets the peers choose per message. Every message is
+	// protected for confidentiality by this package.
+	GSSSelective GSSProtectionLevel = 3
+)
+
+// A GSSMechanism is a GSS-API mechanism such as Kerberos V5.
+type GSSMechanism interface {
+	// AcceptContext returns a new security context of the acceptor,
+	// which is the server.
+	AcceptContext() (GSSContext, error)
+
+	// InitContext returns a new security context of the initiator, which
+	// is the client, for the target service such as "rcmd/proxy.example.com".
+	InitContext(target string) (GSSContext, error)
+}
+
+// A GSSContext is the security context established per connection.
+type GSSContext interface {
+	// Step consumes the token from the peer, which is nil for the first
+	// step of the initiator, and returns the token to send to the peer.
+	// established reports whether the context has been established.
+	Step(token []byte) (output []byte, established bool, err error)
+
+	// Wrap protects the message, and Unwrap verifies it. The message is
+	// encrypted if confidential is true.
+	Wrap(msg []byte, confidential bool) ([]byte, error)
+	Unwrap(token []byte) ([]byte, error)
+
+	// PeerName returns the name of the authenticated peer.
+	PeerName() string
+}
+
+// A ConnAuthenticator is an Authenticator which replaces the connection
+// after the authentication, such as to encapsulate the messages by GSS-API.
+// The identity is nil on the client side.
+type ConnAuthenticator interface {
+	Authenticator
+	AuthenticateConn(conn net.Conn) (net.Conn, *Identity, error)
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+)
+
+// An Identity represents the authenticated peer.
+type Identity struct {
+	// Method is the method used to authenticate the peer.
+	Method Method
+
+	// User is the name of the peer.
+	User string
+
+	// Certificate is the verified client certificate of TLS, if any.
+	Certificate *x509.Certificate
+
+	// Attributes are the attributes of the user such as groups, which are
+	// reported by AttributeStore.
+	Attributes map[string]interface{}
+}
+
+// An IdentityAuthenticator is an Authenticator which also reports
+// who the peer is.
+type IdentityAuthenticator interface {
+	Authenticator
+	AuthenticateIdentity(conn io.ReadWriter) (*Identity, error)
+}
+
+type identityKey struct{}
+
+// NewContext returns a new context that carries the identity.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity stored in ctx, if any.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok && id != nil
+}
@@ -0,0 +1,353 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// An AttributeStore is a CredentialStore which also has the attributes
+// of the users such as groups. The attributes are reported by Identity.
+type AttributeStore interface {
+	CredentialStore
+	Attributes(username string) map[string]interface{}
+}
+
+// user is an entry of the stores.
+type user struct {
+	password   string // plain text, bcrypt or {SHA}
+	attributes map[string]interface{}
+}
+
+// dummyUsers caches the users hashed by bcrypt per cost for dummyUser.
+var (
+	dummyMu    sync.Mutex
+	dummyUsers = make(map[int]*user)
+)
+
+// bcryptCost returns the highest cost of the users hashed by bcrypt, or
+// zero if none of them is.
+func bcryptCost(users map[string]*user) int {
+	cost := 0
+	for _, u := range users {
+		if c, err := bcrypt.Cost([]byte(u.password)); err == nil && c > cost {
+			cost = c
+		}
+	}
+	return cost
+}
+
+// dummyUser returns the user which is compared with the password of
+// unknown users so that it takes as long as the known users. It is hashed
+// by bcrypt at cost, or plain text if cost is zero.
+func dummyUser(cost int) *user {
+	if cost == 0 {
+		return &user{}
+	}
+	dummyMu.Lock()
+	defer dummyMu.Unlock()
+	if u, ok := dummyUsers[cost]; ok {
+		return u
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("dummy"), cost)
+	if err != nil {
+		return &user{}
+	}
+	u := &user{password: string(hash)}
+	dummyUsers[cost] = u
+	return u
+}
+
+// checkPassword returns an error if the password looks like a hash of
+// an unsupported scheme such as "$6$..." or "{SSHA}...", which would be
+// compared as plain text otherwise.
+func checkPassword(password string) error {
+	switch {
+	case isBcrypt(password), strings.HasPrefix(password, "{SHA}"):
+		return nil
+	case strings.HasPrefix(password, "$") && strings.Contains(password[1:], "$"),
+		strings.HasPrefix(password, "{") && strings.Contains(password, "}"):
+		return errors.New("unsupported password hash")
+	}
+	return nil
+}
+
+func isBcrypt(password string) bool {
+	return strings.HasPrefix(password, "$2a$") ||
+		strings.HasPrefix(password, "$2b$") ||
+		strings.HasPrefix(password, "$2y$")
+}
+
+// valid reports whether password matches the password of u in constant time.
+func (u *user) valid(password string) bool {
+	switch {
+	case isBcrypt(u.password):
+		return bcrypt.CompareHashAndPassword([]byte(u.password), []byte(password)) == nil
+	case strings.HasPrefix(u.password, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(u.password[len("{SHA}"):]), []byte(want)) == 1
+	case checkPassword(u.password) != nil:
+		return false
+	}
+	// compares the digests not to leak the length of password.
+	got, want := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(u.password))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
+
+// lookup validates the password of u, or compares it with the dummy user
+// hashed at cost if u is nil.
+func lookup(u *user, cost int, password string) bool {
+	if u == nil {
+		dummyUser(cost).valid(password)
+		return false
+	}
+	return u.valid(password)
+}
+
+var _ CredentialStore = (*MemoryStore)(nil)
+
+// A MemoryStore is a CredentialStore which has users in memory.
+// The passwords may be plain text or hashed by bcrypt or SHA-1 in
+// the format of htpasswd such as "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=".
+// Other schemes such as SHA-256 and SHA-512 crypt ("$5$" and "$6$") are
+// not supported, and the passwords in them never match.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	users map[string]*user
+	cost  int // of bcrypt for the dummy user
+}
+
+// NewMemoryStore returns a new store which has the users mapped to
+// their passwords.
+func NewMemoryStore(users map[string]string) *MemoryStore {
+	m := &MemoryStore{users: make(map[string]*user, len(users))}
+	for username, password := range users {
+		m.users[username] = &user{password: password}
+	}
+	m.cost = bcryptCost(m.users)
+	dummyUser(m.cost) // hashes it in advance
+	return m
+}
+
+// Set adds the user or changes its password.
+func (m *MemoryStore) Set(username, password string) {
+	m.mu.Lock()
+	m.users[username] = &user{password: password}
+	m.cost = bcryptCost(m.users)
+	cost := m.cost
+	m.mu.Unlock()
+	dummyUser(cost) // hashes it in advance out of the lock
+}
+
+// Delete removes the user.
+func (m *MemoryStore) Delete(username string) {
+	m.mu.Lock()
+	delete(m.users, username)
+	m.cost = bcryptCost(m.users)
+	cost := m.cost
+	m.mu.Unlock()
+	dummyUser(cost) // hashes it in advance out of the lock
+}
+
+// Valid reports whether the password of the user matches.
+func (m *MemoryStore) Valid(username, password string) bool {
+	m.mu.RLock()
+	u, cost := m.users[username], m.cost
+	m.mu.RUnlock()
+	return lookup(u, cost, password)
+}
+
+var _ AttributeStore = (*FileStore)(nil)
+
+// A FileStore is a CredentialStore which is loaded from a file. The file
+// is reloaded when its modification time or size changes, which is
+// checked on each authentication. The sessions already authenticated are
+// not affected by the reload. If the changed file is invalid, the error
+// is logged and the previous users are kept.
+type FileStore struct {
+	path  string
+	parse func([]byte) (map[string]*user, error)
+
+	mu      sync.RWMutex
+	users   map[string]*user
+	cost    int // of bcrypt for the dummy user
+	modTime time.Time
+	size    int64
+}
+
+// NewHtpasswdStore returns a store which is loaded from the Apache
+// htpasswd file. The passwords must be hashed by bcrypt ("htpasswd -B")
+// or SHA-1 ("htpasswd -s").
+func NewHtpasswdStore(path string) (*FileStore, error) {
+	return newFileStore(path, parseHtpasswd)
+}
+
+// NewUserFileStore returns a store which is loaded from the JSON or YAML
+// file, which is chosen by the extension ".json", ".yaml" or ".yml".
+// The file has the list of users such as:
+//
+//	users:
+//	  - name: alice
+//	    password: "$2y$05$..."
+//	    attributes:
+//	      groups: [admin]
+//
+// The passwords may be plain text or hashed by bcrypt or SHA-1 as
+// htpasswd. The file which has a password hashed by other schemes such
+// as "$6$..." is rejected.
+func NewUserFileStore(path string) (*FileStore, error) {
+	var unmarshal func([]byte, interface{}) error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		unmarshal = json.Unmarshal
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	default:
+		return nil, fmt.Errorf("unsupported user file: %s", path)
+	}
+	return newFileStore(path, func(b []byte) (map[string]*user, error) {
+		return parseUserFile(b, unmarshal)
+	})
+}
+
+func newFileStore(path string, parse func([]byte) (map[string]*user, error)) (*FileStore, error) {
+	f := &FileStore{
+		path:  path,
+		parse: parse,
+	}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload loads the file regardless of whether it has changed.
+func (f *FileStore) Reload() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	users, err := f.parse(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+	cost := bcryptCost(users)
+	dummyUser(cost) // hashes it in advance out of the lock
+	f.mu.Lock()
+	f.users, f.cost = users, cost
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	f.mu.Unlock()
+	return nil
+}
+
+// reloadIfChanged reloads the file if it has changed since loaded.
+func (f *FileStore) reloadIfChanged() {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		log.Printf("socks5: failed to check credentials: %v", err)
+		return
+	}
+	f.mu.RLock()
+	changed := !fi.ModTime().Equal(f.modTime) || fi.Size() != f.size
+	f.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err := f.Reload(); err != nil {
+		log.Printf("socks5: failed to reload credentials: %v", err)
+	}
+}
+
+// Valid reports whether the password of the user matches.
+func (f *FileStore) Valid(username, password string) bool {
+	f.reloadIfChanged()
+	f.mu.RLock()
+	u, cost := f.users[username], f.cost
+	f.mu.RUnlock()
+	return lookup(u, cost, password)
+}
+
+// Attributes returns the attributes of the user, which is nil if the
+// user has none.
+func (f *FileStore) Attributes(username string) map[string]interface{} {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if u, ok := f.users[username]; ok {
+		return u.attributes
+	}
+	return nil
+}
+
+// parseHtpasswd parses lines of "username:hash". Empty lines and lines
+// which start with "#" are ignored.
+func parseHtpasswd(b []byte) (map[string]*user, error) {
+	users := make(map[string]*user)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: invalid entry", n)
+		}
+		hash := line[i+1:]
+		if !isBcrypt(hash) && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("line %d: unsupported hash of user %q", n, line[:i])
+		}
+		users[line[:i]] = &user{password: hash}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func parseUserFile(b []byte, unmarshal func([]byte, interface{}) error) (map[string]*user, error) {
+	var file struct {
+		Users []struct {
+			Name       string                 `json:"name" yaml:"name"`
+			Password   string                 `json:"password" yaml:"password"`
+			Attributes map[string]interface{} `json:"attributes" yaml:"attributes"`
+		} `json:"users" yaml:"users"`
+	}
+	if err := unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+	users := make(map[string]*user, len(file.Users))
+	for _, u := range file.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("user without name")
+		}
+		if err := checkPassword(u.Password); err != nil {
+			return nil, fmt.Errorf("user %q: %v", u.Name, err)
+		}
+		users[u.Name] = &user{
+			password:   u.Password,
+			attributes: u.Attributes,
+		}
+	}
+	return users, nil
+}
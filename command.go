@@ -18,6 +18,18 @@ const (
 	CmdUDPAssociate
 )
 
+// Extension commands introduced by Tor.
+// See: https://gitweb.torproject.org/torspec.git/tree/socks-extensions.txt
+const (
+	// CmdResolve represents RESOLVE command.
+	// It resolves FQDN in DST.ADDR and returns the address in BND.ADDR.
+	CmdResolve Command = 0xF0
+
+	// CmdResolvePTR represents RESOLVE_PTR command.
+	// It resolves IP address in DST.ADDR and returns the FQDN in BND.ADDR.
+	CmdResolvePTR Command = 0xF1
+)
+
 func (cmd Command) String() string {
 	switch cmd {
 	case CmdConnect:
@@ -26,6 +38,10 @@ func (cmd Command) String() string {
 		return "socks bind"
 	case CmdUDPAssociate:
 		return "socks udp associate"
+	case CmdResolve:
+		return "socks resolve"
+	case CmdResolvePTR:
+		return "socks resolve ptr"
 	default:
 		return fmt.Sprintf("socks %d", cmd)
 	}
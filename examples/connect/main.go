@@ -42,7 +42,15 @@ func main() {
 		log.Fatal(err)
 	}
 	client := http.DefaultClient
-	client.Transport = &http.Transport{Dial: p.Dial}
+	client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := p.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		},
+	}
 
 	log.Println("target", fmt.Sprintf("http://%s/health", httpLn.Addr().String()))
 	resp, err := client.Get(
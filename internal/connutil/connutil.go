@@ -0,0 +1,16 @@
+package connutil
+
+import "io"
+
+// CloseWrite shuts down the writing side of conn to tell the peer that
+// writing has finished. If conn cannot be shut down partially, fallback
+// is closed instead unless it is nil.
+func CloseWrite(conn io.Writer, fallback io.Closer) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	if fallback != nil {
+		return fallback.Close()
+	}
+	return nil
+}
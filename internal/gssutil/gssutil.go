@@ -0,0 +1,229 @@
+package gssutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/Code-Hex/socks5/auth"
+	"github.com/Code-Hex/socks5/internal/connutil"
+)
+
+// ErrAborted returns when the peer aborts the sub-negotiation.
+var ErrAborted = errors.New("gssapi: aborted by peer")
+
+// maxChunk is the size of the message wrapped at once, leaving space for
+// the overhead of the mechanism within 2^16 - 1 octets.
+const maxChunk = 32 * 1024
+
+// WriteMessage writes the message of mtyp which has the token.
+func WriteMessage(w io.Writer, mtyp byte, token []byte) error {
+	if len(token) > 0xffff {
+		return fmt.Errorf("gssapi: too large token: %d bytes", len(token))
+	}
+	b := make([]byte, 4, 4+len(token))
+	b[0], b[1] = auth.GSSAPIVersion, mtyp
+	binary.BigEndian.PutUint16(b[2:], uint16(len(token)))
+	b = append(b, token...)
+	_, err := w.Write(b)
+	return err
+}
+
+// WriteAbort writes the message which aborts the sub-negotiation.
+func WriteAbort(w io.Writer) error {
+	_, err := w.Write([]byte{auth.GSSAPIVersion, auth.GSSAPIAbort})
+	return err
+}
+
+// ReadMessage reads the message of mtyp and returns its token.
+func ReadMessage(r io.Reader, mtyp byte) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header[:2]); err != nil {
+		return nil, err
+	}
+	if header[0] != auth.GSSAPIVersion {
+		return nil, fmt.Errorf("gssapi: unsupported version: %d", header[0])
+	}
+	if header[1] == auth.GSSAPIAbort {
+		return nil, ErrAborted
+	}
+	if header[1] != mtyp {
+		return nil, fmt.Errorf("gssapi: unexpected message type: %d", header[1])
+	}
+	if _, err := io.ReadFull(r, header[2:]); err != nil {
+		return nil, err
+	}
+	token := make([]byte, int(binary.BigEndian.Uint16(header[2:])))
+	if _, err := io.ReadFull(r, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Conn encapsulates the messages by the security context.
+type Conn struct {
+	net.Conn
+	ctx          auth.GSSContext
+	confidential bool
+	buf          []byte
+}
+
+// NewConn returns the connection which protects the messages at the level.
+func NewConn(conn net.Conn, ctx auth.GSSContext, level auth.GSSProtectionLevel) *Conn {
+	return &Conn{
+		Conn:         conn,
+		ctx:          ctx,
+		confidential: level != auth.GSSIntegrity,
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for len(c.buf) == 0 {
+		token, err := ReadMessage(c.Conn, auth.GSSAPIEncapsulation)
+		if err != nil {
+			return 0, err
+		}
+		msg, err := c.ctx.Unwrap(token)
+		if err != nil {
+			return 0, err
+		}
+		c.buf = msg
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		token, err := c.ctx.Wrap(chunk, c.confidential)
+		if err != nil {
+			return written, err
+		}
+		if err := WriteMessage(c.Conn, auth.GSSAPIEncapsulation, token); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// PacketConn returns pc which encapsulates the datagrams of UDP ASSOCIATE
+// by the security context of c, as the server.
+// See: https://tools.ietf.org/html/rfc1961#section-5
+func (c *Conn) PacketConn(pc net.PacketConn) net.PacketConn {
+	return &packetConn{PacketConn: pc, conn: c}
+}
+
+// DatagramConn returns conn which encapsulates the datagrams of UDP
+// ASSOCIATE by the security context of c, as the client.
+func (c *Conn) DatagramConn(conn net.Conn) net.Conn {
+	return &datagramConn{Conn: conn, conn: c}
+}
+
+// wrapDatagram returns the message which encapsulates the datagram b.
+func (c *Conn) wrapDatagram(b []byte) ([]byte, error) {
+	token, err := c.ctx.Wrap(b, c.confidential)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, auth.GSSAPIEncapsulation, token); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unwrapDatagram returns the datagram encapsulated by the message b.
+func (c *Conn) unwrapDatagram(b []byte) ([]byte, error) {
+	r := bytes.NewReader(b)
+	token, err := ReadMessage(r, auth.GSSAPIEncapsulation)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("gssapi: trailing data in datagram")
+	}
+	return c.ctx.Unwrap(token)
+}
+
+// maxDatagram is the size of the UDP datagram read at most.
+const maxDatagram = 64 * 1024
+
+type packetConn struct {
+	net.PacketConn
+	conn *Conn
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxDatagram)
+	n, addr, err := c.PacketConn.ReadFrom(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	msg, err := c.conn.unwrapDatagram(buf[:n])
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(b, msg), addr, nil
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	msg, err := c.conn.wrapDatagram(b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.PacketConn.WriteTo(msg, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+type datagramConn struct {
+	net.Conn
+	conn *Conn
+}
+
+func (c *datagramConn) Read(b []byte) (int, error) {
+	buf := make([]byte, maxDatagram)
+	n, err := c.Conn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	msg, err := c.conn.unwrapDatagram(buf[:n])
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, msg), nil
+}
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	msg, err := c.conn.wrapDatagram(b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side if the underlying connection
+// supports it.
+func (c *Conn) CloseWrite() error {
+	return connutil.CloseWrite(c.Conn, c.Conn)
+}
@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/Code-Hex/socks5/auth"
@@ -14,3 +16,43 @@ func (n *NotRequired) Authenticate(conn io.ReadWriter) error {
 	// nothing to do
 	return nil
 }
+
+var _ auth.Authenticator = (*UsernamePassword)(nil)
+
+// UsernamePassword authenticates to the server by username/password.
+// See: https://tools.ietf.org/html/rfc1929
+type UsernamePassword struct {
+	Username, Password string
+}
+
+func (u *UsernamePassword) Authenticate(conn io.ReadWriter) error {
+	if len(u.Username) == 0 || len(u.Username) > 255 ||
+		len(u.Password) == 0 || len(u.Password) > 255 {
+		return errors.New("invalid username/password")
+	}
+
+	// +----+------+----------+------+----------+
+	// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	// +----+------+----------+------+----------+
+	// | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	// +----+------+----------+------+----------+
+	b := make([]byte, 0, 3+len(u.Username)+len(u.Password))
+	b = append(b, auth.UsernamePasswordVersion, byte(len(u.Username)))
+	b = append(b, u.Username...)
+	b = append(b, byte(len(u.Password)))
+	b = append(b, u.Password...)
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != auth.UsernamePasswordVersion {
+		return fmt.Errorf("unexpected username/password version %d", b[0])
+	}
+	if b[1] != 0x00 {
+		return auth.ErrAuthenticationFailed
+	}
+	return nil
+}
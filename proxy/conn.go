@@ -2,8 +2,10 @@ package proxy
 
 import (
 	"net"
+	"time"
 
 	"github.com/Code-Hex/socks5/address"
+	"github.com/Code-Hex/socks5/internal/connutil"
 	"github.com/Code-Hex/socks5/internal/udputil"
 )
 
@@ -45,6 +47,36 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 	return c.Conn.Write(b)
 }
 
+func (c *Conn) SetDeadline(t time.Time) error {
+	if c.UDPConn != nil {
+		return c.UDPConn.SetDeadline(t)
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	if c.UDPConn != nil {
+		return c.UDPConn.SetReadDeadline(t)
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	if c.UDPConn != nil {
+		return c.UDPConn.SetWriteDeadline(t)
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// CloseWrite shuts down the writing side of the TCP connection.
+// It closes the connection if it cannot be shut down partially.
+func (c *Conn) CloseWrite() error {
+	if c.UDPConn != nil {
+		return c.Close()
+	}
+	return connutil.CloseWrite(c.Conn, c)
+}
+
 func (c *Conn) Close() error {
 	if c.UDPConn != nil {
 		c.UDPConn.Close()
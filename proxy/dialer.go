@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -12,6 +13,8 @@ import (
 	"github.com/Code-Hex/socks5/address"
 	"github.com/Code-Hex/socks5/auth"
 	"github.com/Code-Hex/socks5/internal/addrutil"
+	"github.com/Code-Hex/socks5/internal/gssutil"
+	"golang.org/x/net/websocket"
 )
 
 // A DialListener holds SOCKS-specific options.
@@ -21,6 +24,27 @@ type DialListener struct {
 
 	AuthMethods map[auth.Method]auth.Authenticator
 	Dialer      net.Dialer
+
+	// AuthOrder is the order of AuthMethods offered to the server, the
+	// first one is the most preferred. The methods which are not in
+	// AuthOrder follow it in ascending order of their values.
+	AuthOrder []auth.Method
+
+	// ProxyDial specifies the optional dial function for establishing
+	// the transport connection to the SOCKS server. It can be used to
+	// reach the server through another proxy. Dialer is used if nil.
+	ProxyDial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// TLSConfig, if set, is used to connect to the server over TLS.
+	// Set Certificates to authenticate by the client certificate.
+	// UDP datagrams for UDP ASSOCIATE are not encrypted.
+	TLSConfig *tls.Config
+
+	// WebSocketURL, if set, is used to connect to the server by WebSocket
+	// such as "wss://example.com/socks" instead of the address. TLSConfig
+	// is used for "wss" scheme. UDP datagrams are carried by the messages
+	// of the WebSocket.
+	WebSocketURL string
 }
 
 var ErrCommandUnimplemented = errors.New("command is unimplemented in proxy")
@@ -50,17 +74,16 @@ func (d *DialListener) Dial(network, address string) (*Conn, error) {
 }
 
 func (d *DialListener) DialContext(ctx context.Context, network, address string) (*Conn, error) {
-	if len(d.AuthMethods) == 0 {
-		d.AuthMethods = map[auth.Method]auth.Authenticator{
-			auth.MethodNotRequired: &NotRequired{},
-		}
+	host, port, err := addrutil.SplitHostPort(address)
+	if err != nil {
+		return nil, d.newError(err, network, address)
 	}
 
-	socks5Conn, err := d.Dialer.DialContext(ctx, d.network, d.address)
+	socks5Conn, err := d.dialServer(ctx)
 	if err != nil {
 		return nil, d.newError(err, network, address)
 	}
-	relayAddr, err := d.send(ctx, socks5Conn, address)
+	socks5Conn, relayAddr, err := d.send(ctx, socks5Conn, d.cmd, host, port)
 	if err != nil {
 		return nil, d.newError(err, network, address)
 	}
@@ -68,16 +91,11 @@ func (d *DialListener) DialContext(ctx context.Context, network, address string)
 	var udpConn net.Conn
 	switch network {
 	case "udp", "udp4", "udp6":
-		address := relayAddr.String()
-		udpConn, err = d.Dialer.DialContext(ctx, network, address)
+		udpConn, err = d.dialRelay(ctx, socks5Conn, network, relayAddr)
 		if err != nil {
-			return nil, d.newError(err, network, address)
+			return nil, d.newError(err, network, relayAddr.String())
 		}
 	}
-	host, port, err := addrutil.SplitHostPort(address)
-	if err != nil {
-		return nil, d.newError(err, network, address)
-	}
 	aTyp, ip, err := addrutil.GetAddressInfo(host)
 	if err != nil {
 		return nil, d.newError(err, network, address)
@@ -92,32 +110,98 @@ func (d *DialListener) DialContext(ctx context.Context, network, address string)
 	}, nil
 }
 
-func (d *DialListener) send(ctx context.Context, conn net.Conn, address string) (*address.Info, error) {
-	if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
-		conn.SetDeadline(deadline)
-		defer conn.SetDeadline(time.Time{})
+// dialRelay returns the connection which relays the datagrams of UDP
+// ASSOCIATE, encapsulated if socks5Conn is encapsulated by GSS-API.
+func (d *DialListener) dialRelay(ctx context.Context, socks5Conn net.Conn, network string, relayAddr *address.Info) (net.Conn, error) {
+	gc, encapsulated := socks5Conn.(*gssutil.Conn)
+	if encapsulated {
+		socks5Conn = gc.NetConn()
+	}
+	var conn net.Conn
+	if ws, ok := socks5Conn.(*websocket.Conn); ok {
+		conn = &wsMessageConn{Conn: ws}
+	} else {
+		c, err := d.Dialer.DialContext(ctx, network, relayAddr.String())
+		if err != nil {
+			return nil, err
+		}
+		conn = c
+	}
+	if encapsulated {
+		return gc.DatagramConn(conn), nil
 	}
+	return conn, nil
+}
 
-	host, port, err := addrutil.SplitHostPort(address)
-	if err != nil {
+func (d *DialListener) dialServer(ctx context.Context) (net.Conn, error) {
+	if d.WebSocketURL != "" {
+		return d.dialWebSocket(ctx)
+	}
+	conn, err := d.dial(ctx, d.network, d.address)
+	if err != nil || d.TLSConfig == nil {
+		return conn, err
+	}
+	return d.handshakeTLS(ctx, conn, d.address)
+}
+
+func (d *DialListener) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.ProxyDial != nil {
+		return d.ProxyDial(ctx, network, address)
+	}
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+func (d *DialListener) handshakeTLS(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	config := d.TLSConfig
+	if config == nil {
+		config = new(tls.Config)
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
+		tlsConn.SetDeadline(deadline)
+		defer tlsConn.SetDeadline(time.Time{})
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
 		return nil, err
 	}
+	return tlsConn, nil
+}
+
+// send authenticates and sends the command. The returned connection
+// replaces conn if the authentication method encapsulates it.
+func (d *DialListener) send(ctx context.Context, conn net.Conn, cmd socks5.Command, host string, port int) (net.Conn, *address.Info, error) {
+	if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
 
 	b := make([]byte, 0, 6+len(host)) // the size here is just an estimate
-	if err := d.authenticate(conn, b); err != nil {
-		return nil, err
+	conn, err := d.authenticate(conn, b)
+	if err != nil {
+		return nil, nil, err
 	}
-	return d.sendCommand(conn, b, host, port)
+	addr, err := d.sendCommand(conn, b, cmd, host, port)
+	return conn, addr, err
 }
 
-func (d *DialListener) sendCommand(c net.Conn, bytes []byte, host string, port int) (*address.Info, error) {
+func (d *DialListener) sendCommand(c net.Conn, bytes []byte, cmd socks5.Command, host string, port int) (*address.Info, error) {
 	bytes = bytes[:0]
 	// +----+-----+-------+------+----------+----------+
 	// |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
 	// +----+-----+-------+------+----------+----------+
 	// | 1  |  1  | X'00' |  1   | Variable |    2     |
 	// +----+-----+-------+------+----------+----------+
-	bytes = append(bytes, socks5.Version, byte(d.cmd), 0)
+	bytes = append(bytes, socks5.Version, byte(cmd), 0)
 	aTyp, addr, err := addrutil.GetAddressInfo(host)
 	if err != nil {
 		return nil, err
@@ -155,7 +239,7 @@ func (d *DialListener) readReply(c net.Conn, b []byte) (*address.Info, error) {
 		return nil, fmt.Errorf("unexpected protocol version %d", b[0])
 	}
 	if status := socks5.Reply(b[1]); status != socks5.StatusSucceeded {
-		return nil, errors.New(status.String())
+		return nil, &socks5.ReplyError{Reply: status}
 	}
 	if b[2] != 0 {
 		return nil, errors.New("non-zero reserved field")
@@ -163,44 +247,53 @@ func (d *DialListener) readReply(c net.Conn, b []byte) (*address.Info, error) {
 	return addrutil.Read(c)
 }
 
-func (d *DialListener) authenticate(c net.Conn, bytes []byte) error {
+func (d *DialListener) authenticate(c net.Conn, bytes []byte) (net.Conn, error) {
+	if len(d.AuthMethods) == 0 {
+		d.AuthMethods = map[auth.Method]auth.Authenticator{
+			auth.MethodNotRequired: &NotRequired{},
+		}
+	}
 	methodNum := len(d.AuthMethods)
 	if methodNum > 255 {
-		return errors.New("too many authentication methods")
+		return nil, errors.New("too many authentication methods")
 	}
 	bytes = append(bytes, byte(socks5.Version), byte(methodNum))
-	for method := range d.AuthMethods {
+	for _, method := range auth.MethodOrder(d.AuthOrder, d.AuthMethods) {
 		bytes = append(bytes, byte(method))
 	}
 
 	// write auth information to server
 	if _, err := c.Write(bytes); err != nil {
-		return err
+		return nil, err
 	}
 
 	// read response from server
 	if _, err := io.ReadFull(c, bytes[:2]); err != nil {
-		return err
+		return nil, err
 	}
 
 	// check version
 	if bytes[0] != socks5.Version {
-		return fmt.Errorf("unexpected protocol version %d", bytes[0])
+		return nil, fmt.Errorf("unexpected protocol version %d", bytes[0])
 	}
 
 	return d.assignAuthMethod(c, auth.Method(bytes[1]))
 }
 
-func (d *DialListener) assignAuthMethod(c net.Conn, method auth.Method) error {
+func (d *DialListener) assignAuthMethod(c net.Conn, method auth.Method) (net.Conn, error) {
 	if method == auth.MethodNoAcceptableMethods {
-		return errors.New("no acceptable authentication methods")
+		return nil, errors.New("no acceptable authentication methods")
 	}
 
 	authenticator, ok := d.AuthMethods[method]
 	if !ok {
-		return auth.ErrUnSupportedMethod
+		return nil, auth.ErrUnSupportedMethod
+	}
+	if ca, ok := authenticator.(auth.ConnAuthenticator); ok {
+		conn, _, err := ca.AuthenticateConn(c)
+		return conn, err
 	}
-	return authenticator.Authenticate(c)
+	return c, authenticator.Authenticate(c)
 }
 
 func (d *DialListener) newError(err error, network, address string) error {
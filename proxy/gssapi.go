@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/Code-Hex/socks5/auth"
+	"github.com/Code-Hex/socks5/internal/gssutil"
+)
+
+var _ auth.ConnAuthenticator = (*GSSAPI)(nil)
+
+var errConnRequired = errors.New("gssapi: AuthenticateConn is required to encapsulate the connection")
+
+// GSSAPI authenticates to the server by GSS-API, and encapsulates the
+// rest of the connection and the datagrams of UDP ASSOCIATE at the
+// protection level chosen by the server.
+// See: https://tools.ietf.org/html/rfc1961
+type GSSAPI struct {
+	Mechanism auth.GSSMechanism
+
+	// Target is the name of the proxy service such as
+	// "rcmd/proxy.example.com".
+	Target string
+
+	// Protection is the requested protection level. GSSConfidentiality
+	// if zero. The negotiation is aborted if the server replies
+	// GSSIntegrity to the request of confidentiality.
+	Protection auth.GSSProtectionLevel
+}
+
+// Authenticate always fails since the connection must be encapsulated
+// by AuthenticateConn.
+func (g *GSSAPI) Authenticate(conn io.ReadWriter) error {
+	return errConnRequired
+}
+
+// AuthenticateConn authenticates to the server, and returns the connection
+// which encapsulates the messages.
+func (g *GSSAPI) AuthenticateConn(conn net.Conn) (net.Conn, *auth.Identity, error) {
+	ctx, level, err := g.negotiate(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gssutil.NewConn(conn, ctx, level), nil, nil
+}
+
+func (g *GSSAPI) negotiate(conn io.ReadWriter) (auth.GSSContext, auth.GSSProtectionLevel, error) {
+	if g.Mechanism == nil {
+		return nil, 0, errors.New("no GSS-API mechanism")
+	}
+	ctx, err := g.Mechanism.InitContext(g.Target)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// context establishment
+	output, established, err := ctx.Step(nil)
+	if err != nil {
+		gssutil.WriteAbort(conn)
+		return nil, 0, err
+	}
+	for {
+		if err := gssutil.WriteMessage(conn, auth.GSSAPIAuthentication, output); err != nil {
+			return nil, 0, err
+		}
+		token, err := gssutil.ReadMessage(conn, auth.GSSAPIAuthentication)
+		if err == gssutil.ErrAborted {
+			return nil, 0, auth.ErrAuthenticationFailed
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if established {
+			break
+		}
+		output, established, err = ctx.Step(token)
+		if err != nil {
+			gssutil.WriteAbort(conn)
+			return nil, 0, err
+		}
+		if established && len(output) == 0 {
+			break
+		}
+	}
+
+	// protection level negotiation
+	level := g.Protection
+	if level == 0 {
+		level = auth.GSSConfidentiality
+	}
+	token, err := ctx.Wrap([]byte{byte(level)}, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := gssutil.WriteMessage(conn, auth.GSSAPIProtection, token); err != nil {
+		return nil, 0, err
+	}
+	token, err = gssutil.ReadMessage(conn, auth.GSSAPIProtection)
+	if err != nil {
+		return nil, 0, err
+	}
+	msg, err := ctx.Unwrap(token)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(msg) != 1 || msg[0] < byte(auth.GSSIntegrity) || msg[0] > byte(auth.GSSSelective) {
+		gssutil.WriteAbort(conn)
+		return nil, 0, fmt.Errorf("unexpected GSS-API protection level: %v", msg)
+	}
+	if reply := auth.GSSProtectionLevel(msg[0]); reply == auth.GSSIntegrity && level != auth.GSSIntegrity {
+		gssutil.WriteAbort(conn)
+		return nil, 0, fmt.Errorf("GSS-API protection level is downgraded to %d", reply)
+	}
+	return ctx, auth.GSSProtectionLevel(msg[0]), nil
+}
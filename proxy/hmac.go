@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Code-Hex/socks5/auth"
+)
+
+var _ auth.Authenticator = (*HMACSHA256)(nil)
+
+// HMACSHA256 authenticates to the server by challenge-response with the
+// shared key, so that the key is not sent on the wire. See
+// auth.HMACSHA256Version for the protocol.
+type HMACSHA256 struct {
+	Username string
+	Key      []byte
+}
+
+func (h *HMACSHA256) Authenticate(conn io.ReadWriter) error {
+	if len(h.Username) == 0 || len(h.Username) > 255 || len(h.Key) == 0 {
+		return errors.New("invalid username/key")
+	}
+
+	b := make([]byte, 1+auth.HMACSHA256NonceSize)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if b[0] != auth.HMACSHA256Version {
+		return fmt.Errorf("unexpected hmac-sha256 version %d", b[0])
+	}
+	nonce := b[1:]
+	cnonce := make([]byte, auth.HMACSHA256NonceSize)
+	if _, err := rand.Read(cnonce); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 0, 2+len(h.Username)+len(cnonce)+32)
+	resp = append(resp, auth.HMACSHA256Version, byte(len(h.Username)))
+	resp = append(resp, h.Username...)
+	resp = append(resp, cnonce...)
+	resp = append(resp, auth.HMACSHA256(h.Key, nonce, cnonce, h.Username)...)
+	if _, err := conn.Write(resp); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != auth.HMACSHA256Version {
+		return fmt.Errorf("unexpected hmac-sha256 version %d", b[0])
+	}
+	if b[1] != 0x00 {
+		return auth.ErrAuthenticationFailed
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/internal/connutil"
+)
+
+// An HTTPConnect is a dialer which tunnels TCP connections through an
+// HTTP/1.1 proxy by CONNECT method.
+//
+// Failures are reported as *socks5.ReplyError mapped from the HTTP
+// status code, so the SOCKS server replies with the meaningful code.
+type HTTPConnect struct {
+	Address string // address of the HTTP proxy such as "proxy.example.com:3128"
+
+	// Optional. Basic authentication is used if Username is not empty.
+	Username string
+	Password string
+
+	// TLSConfig, if set, is used to connect to the proxy over TLS.
+	TLSConfig *tls.Config
+
+	// Header is sent with the CONNECT request. Optional.
+	Header http.Header
+
+	Dialer net.Dialer
+}
+
+// DialContext connects to the address through the HTTP proxy.
+// network must be "tcp", "tcp4" or "tcp6".
+func (h *HTTPConnect) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, h.newError(&socks5.ReplyError{
+			Reply: socks5.StatusCommandNotSupported,
+			Err:   fmt.Errorf("network %q is not supported by http proxy", network),
+		}, network, address)
+	}
+
+	conn, err := h.Dialer.DialContext(ctx, "tcp", h.Address)
+	if err != nil {
+		return nil, h.newError(err, network, address)
+	}
+	tunnel, err := h.connect(ctx, conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, h.newError(err, network, address)
+	}
+	return tunnel, nil
+}
+
+func (h *HTTPConnect) connect(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if h.TLSConfig != nil {
+		config := h.TLSConfig.Clone()
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(h.Address)
+			if err != nil {
+				return nil, err
+			}
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	for k, v := range h.Header {
+		req.Header[k] = v
+	}
+	if h.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(h.Username + ":" + h.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &socks5.ReplyError{
+			Reply: replyByHTTPStatus(resp.StatusCode),
+			Err:   fmt.Errorf("http proxy: %s", resp.Status),
+		}
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// replyByHTTPStatus maps the status code of the HTTP proxy to the reply code.
+func replyByHTTPStatus(code int) socks5.Reply {
+	switch code {
+	case http.StatusForbidden,
+		http.StatusProxyAuthRequired,
+		http.StatusUnauthorized:
+		return socks5.StatusNotAllowedByRuleSet
+	case http.StatusBadGateway,
+		http.StatusNotFound:
+		return socks5.StatusHostUnreachable
+	case http.StatusGatewayTimeout,
+		http.StatusRequestTimeout:
+		return socks5.StatusTTLExpired
+	case http.StatusServiceUnavailable:
+		return socks5.StatusNetworkUnreachable
+	case http.StatusMethodNotAllowed,
+		http.StatusNotImplemented:
+		return socks5.StatusCommandNotSupported
+	}
+	return socks5.StatusGeneralServerFailure
+}
+
+func (h *HTTPConnect) newError(err error, network, address string) error {
+	return &net.OpError{
+		Op:     "http connect",
+		Net:    network,
+		Source: newAddr(h.Address, "tcp"),
+		Addr:   newAddr(address, network),
+		Err:    err,
+	}
+}
+
+// bufferedConn reads the data which has been buffered while reading
+// the response before reading the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return connutil.CloseWrite(c.Conn, c)
+}
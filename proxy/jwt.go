@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Code-Hex/socks5/auth"
+)
+
+var _ auth.Authenticator = (*JWT)(nil)
+
+// JWT authenticates to the server by JSON Web Token.
+type JWT struct {
+	Token string
+
+	// PasswordField sends the token as the password of username/password
+	// instead of auth.MethodJWT, so map it to auth.MethodUsernamePassword
+	// then. The token must be up to 255 bytes.
+	PasswordField bool
+}
+
+func (j *JWT) Authenticate(conn io.ReadWriter) error {
+	if j.PasswordField {
+		u := &UsernamePassword{Username: "jwt", Password: j.Token}
+		return u.Authenticate(conn)
+	}
+	if len(j.Token) == 0 || len(j.Token) > 0xffff {
+		return errors.New("invalid token")
+	}
+
+	b := make([]byte, 3, 3+len(j.Token))
+	b[0] = auth.JWTVersion
+	binary.BigEndian.PutUint16(b[1:], uint16(len(j.Token)))
+	b = append(b, j.Token...)
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != auth.JWTVersion {
+		return fmt.Errorf("unexpected jwt version %d", b[0])
+	}
+	if b[1] != 0x00 {
+		return auth.ErrAuthenticationFailed
+	}
+	return nil
+}
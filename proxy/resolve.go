@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/address"
+)
+
+// LookupHost looks up the given host through the SOCKS server using
+// RESOLVE extension command. So the host is never resolved locally.
+//
+// The server returns a single address, it is returned as a slice to
+// match the signature of net.Resolver.
+func (d *DialListener) LookupHost(ctx context.Context, host string) ([]string, error) {
+	info, err := d.resolve(ctx, socks5.CmdResolve, host)
+	if err != nil {
+		return nil, d.newDNSError(err, host)
+	}
+	switch info.Type {
+	case address.TypeIPv4, address.TypeIPv6:
+		return []string{net.IP(info.Host).String()}, nil
+	}
+	return nil, d.newDNSError(&address.Unrecognized{Type: info.Type}, host)
+}
+
+// LookupAddr performs a reverse lookup for the given address through
+// the SOCKS server using RESOLVE_PTR extension command.
+func (d *DialListener) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if net.ParseIP(addr) == nil {
+		return nil, &net.DNSError{
+			Err:  "unrecognized address",
+			Name: addr,
+		}
+	}
+	info, err := d.resolve(ctx, socks5.CmdResolvePTR, addr)
+	if err != nil {
+		return nil, d.newDNSError(err, addr)
+	}
+	if info.Type != address.TypeFQDN {
+		return nil, d.newDNSError(&address.Unrecognized{Type: info.Type}, addr)
+	}
+	return []string{info.Host.String()}, nil
+}
+
+func (d *DialListener) resolve(ctx context.Context, cmd socks5.Command, host string) (*address.Info, error) {
+	conn, err := d.dialServer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// DST.PORT is ignored by the server.
+	_, info, err := d.send(ctx, conn, cmd, host, 0)
+	return info, err
+}
+
+func (d *DialListener) newDNSError(err error, name string) error {
+	return &net.DNSError{
+		Err:    err.Error(),
+		Name:   name,
+		Server: d.address,
+	}
+}
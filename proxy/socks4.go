@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/internal/addrutil"
+)
+
+// A Socks4Dialer holds SOCKS4-specific options.
+//
+// The destinations specified by FQDN are resolved by the server with
+// SOCKS4a extension unless ResolveLocally is true. Requests which are
+// not granted are reported as *socks5.Socks4ReplyError.
+type Socks4Dialer struct {
+	cmd              socks5.Command // CmdConnect
+	network, address string         // these fields for socks4
+
+	UserID string
+
+	// ResolveLocally resolves FQDN destinations by Dialer.Resolver
+	// for the servers which do not support SOCKS4a.
+	ResolveLocally bool
+
+	Dialer net.Dialer
+
+	// ProxyDial specifies the optional dial function for establishing
+	// the transport connection to the SOCKS server. Dialer is used if nil.
+	ProxyDial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Socks4 returns a dialer for the SOCKS4 server at address.
+// cmd must be CmdConnect, BIND is not supported by the client.
+func Socks4(ctx context.Context, cmd socks5.Command, network, address string) (*Socks4Dialer, error) {
+	switch cmd {
+	case socks5.CmdConnect:
+	default:
+		return nil, &net.OpError{
+			Op:   cmd.String(),
+			Net:  network,
+			Addr: newAddr(address, network),
+			Err:  ErrCommandUnimplemented,
+		}
+	}
+	return &Socks4Dialer{
+		cmd:     cmd,
+		network: network,
+		address: address,
+	}, nil
+}
+
+func (d *Socks4Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address through the server. network must
+// be "tcp" or "tcp4" since SOCKS4 supports IPv4 only.
+func (d *Socks4Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, d.newError(fmt.Errorf("network %q is not supported by socks4", network), network, address)
+	}
+	host, port, err := addrutil.SplitHostPort(address)
+	if err != nil {
+		return nil, d.newError(err, network, address)
+	}
+
+	var ip net.IP
+	if parsed := net.ParseIP(host); parsed != nil {
+		ip = parsed.To4()
+		if ip == nil {
+			return nil, d.newError(errors.New("socks4 does not support IPv6 address"), network, address)
+		}
+		host = ""
+	} else if d.ResolveLocally {
+		ip, err = d.lookupIPv4(ctx, host)
+		if err != nil {
+			return nil, d.newError(err, network, address)
+		}
+		host = ""
+	}
+
+	conn, err := d.dialServer(ctx)
+	if err != nil {
+		return nil, d.newError(err, network, address)
+	}
+	if err := d.send(ctx, conn, ip, host, port); err != nil {
+		conn.Close()
+		return nil, d.newError(err, network, address)
+	}
+	return conn, nil
+}
+
+func (d *Socks4Dialer) lookupIPv4(ctx context.Context, host string) (net.IP, error) {
+	resolver := d.Dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ip := addr.IP.To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, &net.DNSError{
+		Err:        "no IPv4 address",
+		Name:       host,
+		IsNotFound: true,
+	}
+}
+
+func (d *Socks4Dialer) dialServer(ctx context.Context) (net.Conn, error) {
+	if d.ProxyDial != nil {
+		return d.ProxyDial(ctx, d.network, d.address)
+	}
+	return d.Dialer.DialContext(ctx, d.network, d.address)
+}
+
+// send sends the request. ip is ignored and SOCKS4a is used if host is not empty.
+func (d *Socks4Dialer) send(ctx context.Context, conn net.Conn, ip net.IP, host string, port int) error {
+	if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	// +----+----+----+----+----+----+----+----+----+----+....+----+
+	// | VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+	// +----+----+----+----+----+----+----+----+----+----+....+----+
+	// | 1  | 1  |    2    |         4         | variable     | 1  |
+	// +----+----+----+----+----+----+----+----+----+----+....+----+
+	b := make([]byte, 0, 10+len(d.UserID)+len(host))
+	b = append(b, socks5.Socks4Version, byte(d.cmd), byte(port>>8), byte(port))
+	if host != "" {
+		// SOCKS4a: 0.0.0.x followed by the hostname.
+		b = append(b, 0, 0, 0, 1)
+	} else {
+		b = append(b, ip...)
+	}
+	b = append(b, d.UserID...)
+	b = append(b, 0)
+	if host != "" {
+		b = append(b, host...)
+		b = append(b, 0)
+	}
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+
+	// +----+----+----+----+----+----+----+----+
+	// | VN | CD | DSTPORT |      DSTIP        |
+	// +----+----+----+----+----+----+----+----+
+	// | 1  | 1  |    2    |         4         |
+	// +----+----+----+----+----+----+----+----+
+	b = b[:8]
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if b[0] != 0 {
+		return fmt.Errorf("unexpected reply version %d", b[0])
+	}
+	if code := socks5.Socks4Reply(b[1]); code != socks5.Socks4Granted {
+		return &socks5.Socks4ReplyError{Reply: code}
+	}
+	return nil
+}
+
+func (d *Socks4Dialer) newError(err error, network, address string) error {
+	return &net.OpError{
+		Op:     d.cmd.String(),
+		Net:    network,
+		Source: newAddr(d.address, d.network),
+		Addr:   newAddr(address, network),
+		Err:    err,
+	}
+}
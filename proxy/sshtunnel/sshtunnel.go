@@ -0,0 +1,350 @@
+// Package sshtunnel provides a dialer which forwards connections through
+// an SSH server like "ssh -D". It can be used as server.Config.DialContext.
+package sshtunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/proxy"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const defaultKeepAliveInterval = 30 * time.Second
+
+var errClosed = errors.New("sshtunnel: dialer closed")
+
+// Config is the configuration of Dialer.
+type Config struct {
+	Address string // address of the SSH server such as "bastion.example.com:22"
+	User    string
+
+	// Password and/or PrivateKey are used to authenticate. PrivateKey is
+	// PEM encoded, Passphrase is used if it is encrypted.
+	// PrivateKeyFile is read if PrivateKey is empty.
+	Password       string
+	PrivateKey     []byte
+	PrivateKeyFile string
+	Passphrase     []byte
+
+	// KnownHostsFiles are OpenSSH known_hosts files to verify the host key.
+	// HostKeyCallback is used instead if it is set. Either is required.
+	KnownHostsFiles []string
+	HostKeyCallback ssh.HostKeyCallback
+
+	// Optional.
+	KeepAliveInterval time.Duration // 30s if zero, disabled if negative
+	Timeout           time.Duration // timeout of the dial and the SSH handshake
+	Dialer            net.Dialer
+}
+
+// A Dialer forwards TCP connections through an SSH server by direct-tcpip
+// channels. The SSH connection is established lazily, kept alive and
+// re-established automatically when it is lost.
+type Dialer struct {
+	address   string
+	config    *ssh.ClientConfig
+	keepAlive time.Duration
+	timeout   time.Duration
+	dialer    net.Dialer
+
+	mu         sync.Mutex
+	client     *ssh.Client
+	connecting chan struct{} // closed when the connection attempt finishes
+	closed     bool
+}
+
+// New returns a new Dialer. It does not connect to the SSH server.
+func New(c *Config) (*Dialer, error) {
+	var methods []ssh.AuthMethod
+	privateKey := c.PrivateKey
+	if len(privateKey) == 0 && c.PrivateKeyFile != "" {
+		b, err := ioutil.ReadFile(c.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = b
+	}
+	if len(privateKey) > 0 {
+		var (
+			signer ssh.Signer
+			err    error
+		)
+		if len(c.Passphrase) > 0 {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, c.Passphrase)
+		} else {
+			signer, err = ssh.ParsePrivateKey(privateKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if c.Password != "" {
+		methods = append(methods, ssh.Password(c.Password))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("sshtunnel: password or private key is required")
+	}
+
+	hostKeyCallback := c.HostKeyCallback
+	if hostKeyCallback == nil {
+		if len(c.KnownHostsFiles) == 0 {
+			return nil, errors.New("sshtunnel: known hosts files or host key callback is required")
+		}
+		callback, err := knownhosts.New(c.KnownHostsFiles...)
+		if err != nil {
+			return nil, err
+		}
+		hostKeyCallback = callback
+	}
+
+	keepAlive := c.KeepAliveInterval
+	if keepAlive == 0 {
+		keepAlive = defaultKeepAliveInterval
+	}
+	return &Dialer{
+		address: c.Address,
+		config: &ssh.ClientConfig{
+			User:            c.User,
+			Auth:            methods,
+			HostKeyCallback: hostKeyCallback,
+		},
+		keepAlive: keepAlive,
+		timeout:   c.Timeout,
+		dialer:    c.Dialer,
+	}, nil
+}
+
+// DialContext connects to the address through the SSH server.
+// network must be "tcp", "tcp4" or "tcp6".
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, d.newError(&socks5.ReplyError{
+			Reply: socks5.StatusCommandNotSupported,
+			Err:   fmt.Errorf("network %q is not supported by ssh tunnel", network),
+		}, network, address)
+	}
+
+	client, err := d.getClient(ctx)
+	if err != nil {
+		return nil, d.newError(err, network, address)
+	}
+	conn, err := d.dial(ctx, client, network, address)
+	if err == nil {
+		return conn, nil
+	}
+	if _, ok := err.(*ssh.OpenChannelError); ok || ctx.Err() != nil {
+		return nil, d.newError(replyError(err), network, address)
+	}
+
+	// The SSH connection may have been lost. Reconnect once.
+	d.dropClient(client)
+	client, err = d.getClient(ctx)
+	if err != nil {
+		return nil, d.newError(err, network, address)
+	}
+	conn, err = d.dial(ctx, client, network, address)
+	if err != nil {
+		return nil, d.newError(replyError(err), network, address)
+	}
+	return conn, nil
+}
+
+// Close closes the SSH connection. Channels which are opened are also closed.
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	if d.client == nil {
+		return nil
+	}
+	err := d.client.Close()
+	d.client = nil
+	return err
+}
+
+func (d *Dialer) dial(ctx context.Context, client *ssh.Client, network, address string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := client.Dial(network, address)
+		ch <- result{conn, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-ch; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// getClient returns the SSH client, connecting if there is none. Only one
+// caller connects at a time, the others wait for it without holding d.mu.
+func (d *Dialer) getClient(ctx context.Context) (*ssh.Client, error) {
+	for {
+		d.mu.Lock()
+		if d.closed {
+			d.mu.Unlock()
+			return nil, errClosed
+		}
+		if d.client != nil {
+			client := d.client
+			d.mu.Unlock()
+			return client, nil
+		}
+		if d.connecting == nil {
+			break // d.mu is held
+		}
+		connecting := d.connecting
+		d.mu.Unlock()
+		select {
+		case <-connecting:
+			// the client is connected, or retry if it failed.
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	connecting := make(chan struct{})
+	d.connecting = connecting
+	d.mu.Unlock()
+
+	client, err := d.connect(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.connecting = nil
+	close(connecting)
+	if err != nil {
+		return nil, err
+	}
+	if d.closed {
+		client.Close()
+		return nil, errClosed
+	}
+	d.client = client
+	go func() {
+		client.Wait()
+		d.dropClient(client)
+	}()
+	if d.keepAlive > 0 {
+		go d.keepAliveLoop(client)
+	}
+	return client, nil
+}
+
+// connect dials the SSH server and does the handshake within the timeout.
+func (d *Dialer) connect(ctx context.Context) (*ssh.Client, error) {
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.address, d.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// dropClient forgets the client if it is still in use, so that the next
+// dial reconnects.
+func (d *Dialer) dropClient(client *ssh.Client) {
+	d.mu.Lock()
+	if d.client == client {
+		d.client = nil
+	}
+	d.mu.Unlock()
+	client.Close()
+}
+
+// keepAliveLoop sends keepalive requests, and drops the client if the
+// server does not reply within the interval.
+func (d *Dialer) keepAliveLoop(client *ssh.Client) {
+	ticker := time.NewTicker(d.keepAlive)
+	defer ticker.Stop()
+	for range ticker.C {
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			errc <- err
+		}()
+		timer := time.NewTimer(d.keepAlive)
+		select {
+		case err := <-errc:
+			timer.Stop()
+			if err != nil {
+				d.dropClient(client)
+				return
+			}
+		case <-timer.C:
+			// closing the client also unblocks SendRequest.
+			d.dropClient(client)
+			return
+		}
+	}
+}
+
+// replyError maps the failure of opening a direct-tcpip channel to
+// the reply code.
+func replyError(err error) error {
+	oce, ok := err.(*ssh.OpenChannelError)
+	if !ok {
+		return err
+	}
+	reply := socks5.StatusGeneralServerFailure
+	switch oce.Reason {
+	case ssh.Prohibited:
+		reply = socks5.StatusNotAllowedByRuleSet
+	case ssh.ConnectionFailed:
+		reply = socks5.StatusHostUnreachable
+	case ssh.UnknownChannelType:
+		reply = socks5.StatusCommandNotSupported
+	}
+	return &socks5.ReplyError{Reply: reply, Err: err}
+}
+
+func (d *Dialer) newError(err error, network, address string) error {
+	return &net.OpError{
+		Op:     "ssh tunnel",
+		Net:    network,
+		Source: newAddr(d.address, "tcp"),
+		Addr:   newAddr(address, network),
+		Err:    err,
+	}
+}
+
+func newAddr(address, network string) net.Addr {
+	host, port, _ := net.SplitHostPort(address)
+	return &proxy.Addr{
+		Host: host,
+		Port: port,
+		Net:  network,
+	}
+}
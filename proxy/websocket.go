@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func (d *DialListener) dialWebSocket(ctx context.Context) (net.Conn, error) {
+	u, err := url.Parse(d.WebSocketURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	switch {
+	case u.Scheme != "ws" && u.Scheme != "wss":
+		return nil, fmt.Errorf("unsupported websocket scheme: %q", u.Scheme)
+	case port != "":
+	case u.Scheme == "ws":
+		port = "80"
+	default:
+		port = "443"
+	}
+	address := net.JoinHostPort(u.Hostname(), port)
+
+	conn, err := d.dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		conn, err = d.handshakeTLS(ctx, conn, address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == "wss" {
+		origin.Scheme = "https"
+	}
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// wsMessageConn carries a datagram by a message of WebSocket.
+type wsMessageConn struct {
+	*websocket.Conn
+}
+
+func (c *wsMessageConn) Read(b []byte) (int, error) {
+	var msg []byte
+	if err := websocket.Message.Receive(c.Conn, &msg); err != nil {
+		return 0, err
+	}
+	return copy(b, msg), nil
+}
+
+func (c *wsMessageConn) Write(b []byte) (int, error) {
+	if err := websocket.Message.Send(c.Conn, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close does nothing, the WebSocket connection is closed by Conn.
+func (c *wsMessageConn) Close() error {
+	return nil
+}
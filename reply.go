@@ -51,3 +51,20 @@ func (code Reply) String() string {
 		return fmt.Sprintf("unknown code: %d", code)
 	}
 }
+
+// A ReplyError represents an error which should be replied to the
+// client with the Reply code.
+type ReplyError struct {
+	Reply Reply
+	Err   error // optional
+}
+
+func (e *ReplyError) Error() string {
+	if e.Err == nil {
+		return e.Reply.String()
+	}
+	return e.Reply.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ReplyError) Unwrap() error { return e.Err }
@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"time"
 
 	"github.com/Code-Hex/socks5"
 	"github.com/Code-Hex/socks5/auth"
@@ -22,42 +23,183 @@ func (n *NotRequired) Authenticate(conn io.ReadWriter) error {
 	return err
 }
 
-func (s *Socks5) authenticate(conn net.Conn) error {
+// authenticate negotiates the method and authenticates the client.
+// The identity is nil if the authenticator does not report it. The
+// returned connection replaces conn if the method encapsulates it.
+func (s *Socks5) authenticate(conn net.Conn) (net.Conn, *auth.Identity, error) {
 	// Read the version byte
 	header := make([]byte, 2)
-	if _, err := conn.Read(header); err != nil {
-		return fmt.Errorf("failed to get authenticate information: %v", err)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, nil, fmt.Errorf("failed to get authenticate information: %v", err)
 	}
 
 	// Ensure we are compatible
 	if header[0] != socks5.Version {
-		return fmt.Errorf("unsupported version: %d", header[0])
+		return nil, nil, fmt.Errorf("unsupported version: %d", header[0])
 	}
 
 	numMethods := int(header[1])
 	methods := make([]byte, numMethods)
 	if _, err := io.ReadAtLeast(conn, methods, numMethods); err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	authenticator, err := s.methodAssign(methods)
+	authenticator, err := s.methodAssign(methods, conn.RemoteAddr())
 	if err != nil {
 		_, e := conn.Write([]byte{
 			socks5.Version,
 			byte(auth.MethodNoAcceptableMethods),
 		})
 		log.Println(e)
-		return err
+		return nil, nil, err
 	}
-	return authenticator.Authenticate(conn)
+	switch a := authenticator.(type) {
+	case auth.ConnAuthenticator:
+		return a.AuthenticateConn(conn)
+	case auth.IdentityAuthenticator:
+		id, err := a.AuthenticateIdentity(conn)
+		return conn, id, err
+	}
+	return conn, nil, authenticator.Authenticate(conn)
 }
 
-func (s *Socks5) methodAssign(methods []byte) (auth.Authenticator, error) {
+// methodAssign selects the authenticator of the methods offered by the
+// client by AuthPolicy.
+func (s *Socks5) methodAssign(methods []byte, addr net.Addr) (auth.Authenticator, error) {
+	if s.config.AuthPolicy.Preference == ServerPreferred {
+		offered := make(map[auth.Method]bool, len(methods))
+		for _, b := range methods {
+			offered[auth.Method(b)] = true
+		}
+		for _, method := range s.methodOrder {
+			if offered[method] && s.allowedMethod(addr, method) {
+				return s.config.AuthMethods[method], nil
+			}
+		}
+		return nil, auth.ErrUnSupportedMethod
+	}
 	for _, b := range methods {
 		method := auth.Method(b) // type cast
-		if authenticator, ok := s.config.AuthMethods[method]; ok {
-			return authenticator, nil
+		if s.allowedMethod(addr, method) {
+			return s.config.AuthMethods[method], nil
 		}
 	}
 	return nil, auth.ErrUnSupportedMethod
 }
+
+var _ auth.IdentityAuthenticator = (*UsernamePassword)(nil)
+
+// UsernamePassword authenticates the client by username/password.
+// See: https://tools.ietf.org/html/rfc1929
+type UsernamePassword struct {
+	Credentials auth.CredentialStore
+
+	guard *AuthGuard // set by New from Config.AuthGuard
+}
+
+func (u *UsernamePassword) Authenticate(conn io.ReadWriter) error {
+	_, err := u.AuthenticateIdentity(conn)
+	return err
+}
+
+// AuthenticateIdentity authenticates the client, and returns the identity
+// which has the username.
+func (u *UsernamePassword) AuthenticateIdentity(conn io.ReadWriter) (*auth.Identity, error) {
+	if _, err := conn.Write([]byte{
+		socks5.Version,
+		byte(auth.MethodUsernamePassword),
+	}); err != nil {
+		return nil, err
+	}
+
+	username, password, err := readUsernamePassword(conn)
+	if err != nil {
+		return nil, err
+	}
+	var addr net.Addr
+	if c, ok := conn.(net.Conn); ok {
+		addr = c.RemoteAddr()
+	}
+	valid := u.valid(addr, username, password)
+	if err := writeUsernamePasswordStatus(conn, valid); err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, auth.ErrAuthenticationFailed
+	}
+	return u.identity(username), nil
+}
+
+// valid validates the credentials of the client at addr. With AuthGuard,
+// the banned users are rejected, and the failure is delayed before it is
+// answered.
+func (u *UsernamePassword) valid(addr net.Addr, username, password string) bool {
+	if u.guard != nil && u.guard.bannedUser(username) {
+		return false
+	}
+	valid := u.Credentials != nil && u.Credentials.Valid(username, password)
+	if u.guard != nil {
+		if valid {
+			u.guard.succeedUser(username)
+		} else {
+			time.Sleep(u.guard.failUser(addr, username))
+		}
+	}
+	return valid
+}
+
+// identity returns the identity of the authenticated user, which has
+// the attributes if Credentials is an auth.AttributeStore.
+func (u *UsernamePassword) identity(username string) *auth.Identity {
+	id := &auth.Identity{
+		Method: auth.MethodUsernamePassword,
+		User:   username,
+	}
+	if as, ok := u.Credentials.(auth.AttributeStore); ok {
+		id.Attributes = as.Attributes(username)
+	}
+	return id
+}
+
+func readUsernamePassword(conn io.Reader) (username, password string, err error) {
+	// +----+------+----------+------+----------+
+	// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	// +----+------+----------+------+----------+
+	// | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	// +----+------+----------+------+----------+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != auth.UsernamePasswordVersion {
+		return "", "", fmt.Errorf("unsupported username/password version: %d", header[0])
+	}
+	uname := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(conn, uname); err != nil {
+		return "", "", err
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return "", "", err
+	}
+	passwd := make([]byte, int(header[0]))
+	if _, err := io.ReadFull(conn, passwd); err != nil {
+		return "", "", err
+	}
+	return string(uname), string(passwd), nil
+}
+
+func writeUsernamePasswordStatus(conn io.Writer, valid bool) error {
+	// +----+--------+
+	// |VER | STATUS |
+	// +----+--------+
+	// | 1  |   1    |
+	// +----+--------+
+	//
+	// A STATUS field of X'00' indicates success.
+	status := byte(0x01)
+	if valid {
+		status = 0x00
+	}
+	_, err := conn.Write([]byte{auth.UsernamePasswordVersion, status})
+	return err
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/Code-Hex/socks5/auth"
+)
+
+// MethodPreference decides whose order selects the authentication method.
+type MethodPreference int
+
+const (
+	// ClientPreferred selects the first method offered by the client
+	// which the server supports.
+	ClientPreferred MethodPreference = iota
+	// ServerPreferred selects the first method in AuthPolicy.Order
+	// which the client offers.
+	ServerPreferred
+)
+
+// A MethodRequirement restricts the authentication methods of the clients
+// in the network.
+type MethodRequirement struct {
+	Network *net.IPNet
+	Methods []auth.Method
+}
+
+// AuthPolicy is the policy to select the authentication method.
+type AuthPolicy struct {
+	Preference MethodPreference
+
+	// Order is the order of methods preferred by the server. The methods
+	// of AuthMethods which are not in Order follow it in ascending order
+	// of their values.
+	Order []auth.Method
+
+	// Required restricts the methods per client network. The first one
+	// which contains the client address applies, and the clients in no
+	// networks may use any method of AuthMethods. The clients whose IP
+	// address is unknown are rejected if Required is set. SOCKS4 clients in the
+	// network are served only if MethodNotRequired is in Methods, and
+	// HTTP proxy clients need MethodUsernamePassword for Proxy-Authorization
+	// or MethodNotRequired.
+	Required []MethodRequirement
+}
+
+var errMethodNotAllowed = errors.New("no authentication method is allowed for the client")
+
+// allowedMethod reports whether the client at addr may use method m.
+func (s *Socks5) allowedMethod(addr net.Addr, m auth.Method) bool {
+	_, ok := s.config.AuthMethods[m]
+	return ok && s.permittedMethod(addr, m)
+}
+
+// permittedMethod reports whether AuthPolicy.Required permits the client
+// at addr to use method m.
+func (s *Socks5) permittedMethod(addr net.Addr, m auth.Method) bool {
+	required := s.config.AuthPolicy.Required
+	if len(required) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+	if ip == nil {
+		// the client may be in any network.
+		return false
+	}
+	for _, r := range required {
+		if !r.Network.Contains(ip) {
+			continue
+		}
+		for _, allowed := range r.Methods {
+			if allowed == m {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
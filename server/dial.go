@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// IPPolicy represents which address families are used to reach
+// a destination specified by FQDN.
+type IPPolicy int
+
+const (
+	// PreferIPv6 races both address families, starting with IPv6.
+	// This is the default behaviour recommended by RFC 8305.
+	PreferIPv6 IPPolicy = iota
+
+	// PreferIPv4 races both address families, starting with IPv4.
+	PreferIPv4
+
+	// IPv4Only uses IPv4 addresses only.
+	IPv4Only
+
+	// IPv6Only uses IPv6 addresses only.
+	IPv6Only
+)
+
+func (p IPPolicy) String() string {
+	switch p {
+	case PreferIPv6:
+		return "prefer ipv6"
+	case PreferIPv4:
+		return "prefer ipv4"
+	case IPv4Only:
+		return "ipv4 only"
+	case IPv6Only:
+		return "ipv6 only"
+	}
+	return "unknown"
+}
+
+// See: Page 15 in https://tools.ietf.org/html/rfc8305
+const (
+	defaultResolutionDelay        = 50 * time.Millisecond
+	defaultConnectionAttemptDelay = 250 * time.Millisecond
+)
+
+// HappyEyeballs is a dialer which implements "Happy Eyeballs Version 2"
+// (RFC 8305). It resolves both address families of the destination and
+// races connection attempts with staggered delays.
+type HappyEyeballs struct {
+	Policy IPPolicy
+
+	// Optional.
+	Resolver               *net.Resolver
+	Dialer                 net.Dialer
+	ResolutionDelay        time.Duration // 50ms if zero
+	ConnectionAttemptDelay time.Duration // 250ms if zero
+}
+
+// DialContext connects to the address on the named network.
+// Only "tcp" networks with FQDN host are raced, others are dialed
+// directly with the address family restricted by the policy.
+func (h *HappyEyeballs) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := h.Dialer
+	if dialer.Resolver == nil {
+		dialer.Resolver = h.Resolver
+	}
+	network = h.network(network)
+	if network != "tcp" {
+		return dialer.DialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	return h.race(ctx, &dialer, host, port)
+}
+
+// network restricts network by the policy. e.g. "tcp" to "tcp4".
+func (h *HappyEyeballs) network(network string) string {
+	switch network {
+	case "tcp", "udp", "ip":
+		switch h.Policy {
+		case IPv4Only:
+			return network + "4"
+		case IPv6Only:
+			return network + "6"
+		}
+	}
+	return network
+}
+
+type lookupResult struct {
+	ips []net.IP
+	ip6 bool
+	err error
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+func (h *HappyEyeballs) lookup(ctx context.Context, host string) (<-chan *lookupResult, int) {
+	resolver := h.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	var networks []string
+	switch h.Policy {
+	case IPv4Only:
+		networks = []string{"ip4"}
+	case IPv6Only:
+		networks = []string{"ip6"}
+	default:
+		networks = []string{"ip6", "ip4"}
+	}
+	ch := make(chan *lookupResult, len(networks))
+	for _, network := range networks {
+		network := network
+		go func() {
+			ips, err := resolver.LookupIP(ctx, network, host)
+			ch <- &lookupResult{
+				ips: ips,
+				ip6: network == "ip6",
+				err: err,
+			}
+		}()
+	}
+	return ch, len(networks)
+}
+
+// race implements the connection algorithm described in Section 5 of RFC 8305.
+func (h *HappyEyeballs) race(ctx context.Context, dialer *net.Dialer, host, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resolutionDelay := h.ResolutionDelay
+	if resolutionDelay <= 0 {
+		resolutionDelay = defaultResolutionDelay
+	}
+	attemptDelay := h.ConnectionAttemptDelay
+	if attemptDelay <= 0 {
+		attemptDelay = defaultConnectionAttemptDelay
+	}
+	preferIPv6 := h.Policy != PreferIPv4
+
+	lookups, pending := h.lookup(ctx, host)
+	results := make(chan *dialResult)
+
+	var (
+		preferred, others []net.IP
+		nextPreferred     = true
+		ready             bool
+		inflight          int
+		firstErr          error
+		lookupErr         error
+		resolution        <-chan time.Time
+		attempt           <-chan time.Time
+	)
+
+	next := func() net.IP {
+		var ip net.IP
+		switch {
+		case len(preferred) > 0 && (nextPreferred || len(others) == 0):
+			ip, preferred = preferred[0], preferred[1:]
+			nextPreferred = false
+		case len(others) > 0:
+			ip, others = others[0], others[1:]
+			nextPreferred = true
+		}
+		return ip
+	}
+
+	start := func() {
+		ip := next()
+		if ip == nil {
+			attempt = nil
+			return
+		}
+		inflight++
+		addr := net.JoinHostPort(ip.String(), port)
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			results <- &dialResult{conn: conn, err: err}
+		}()
+		attempt = time.After(attemptDelay)
+	}
+
+	for {
+		select {
+		case res := <-lookups:
+			pending--
+			if res.err != nil {
+				if lookupErr == nil {
+					lookupErr = res.err
+				}
+			} else if res.ip6 == preferIPv6 {
+				preferred = append(preferred, res.ips...)
+			} else {
+				others = append(others, res.ips...)
+			}
+			switch {
+			case ready:
+			case res.ip6 == preferIPv6 || pending == 0:
+				ready = true
+			case res.err == nil:
+				// Wait a short time for the preferred family.
+				resolution = time.After(resolutionDelay)
+			}
+			if ready && inflight == 0 {
+				start()
+			}
+		case <-resolution:
+			resolution = nil
+			if !ready {
+				ready = true
+				start()
+			}
+		case <-attempt:
+			start()
+		case res := <-results:
+			inflight--
+			if res.err == nil {
+				go drain(results, inflight)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if ready {
+				start()
+			}
+		case <-ctx.Done():
+			go drain(results, inflight)
+			return nil, ctx.Err()
+		}
+
+		if ready && inflight == 0 && pending == 0 &&
+			len(preferred) == 0 && len(others) == 0 {
+			switch {
+			case firstErr != nil:
+				return nil, firstErr
+			case lookupErr != nil:
+				return nil, lookupErr
+			}
+			return nil, &net.AddrError{
+				Err:  "no suitable address found",
+				Addr: host,
+			}
+		}
+	}
+}
+
+// drain closes connections established by the losers of the race.
+func drain(results <-chan *dialResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.conn != nil {
+			res.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/auth"
+	"github.com/Code-Hex/socks5/internal/gssutil"
+)
+
+var _ auth.ConnAuthenticator = (*GSSAPI)(nil)
+
+var errConnRequired = errors.New("gssapi: AuthenticateConn is required to encapsulate the connection")
+
+// GSSAPI authenticates the client by GSS-API, and encapsulates the rest
+// of the connection and the datagrams of UDP ASSOCIATE at the negotiated
+// protection level. The datagrams are relayed on the socket of each
+// association since they are encapsulated by its security context.
+// See: https://tools.ietf.org/html/rfc1961
+type GSSAPI struct {
+	Mechanism auth.GSSMechanism
+
+	// Protection, if set, is the protection level replied to the clients
+	// regardless of their requests.
+	Protection auth.GSSProtectionLevel
+}
+
+// Authenticate always fails since the connection must be encapsulated
+// by AuthenticateConn.
+func (g *GSSAPI) Authenticate(conn io.ReadWriter) error {
+	return errConnRequired
+}
+
+// AuthenticateConn authenticates the client, and returns the connection
+// which encapsulates the messages and the identity of the peer name.
+func (g *GSSAPI) AuthenticateConn(conn net.Conn) (net.Conn, *auth.Identity, error) {
+	ctx, level, id, err := g.negotiate(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gssutil.NewConn(conn, ctx, level), id, nil
+}
+
+func (g *GSSAPI) negotiate(conn io.ReadWriter) (auth.GSSContext, auth.GSSProtectionLevel, *auth.Identity, error) {
+	if _, err := conn.Write([]byte{
+		socks5.Version,
+		byte(auth.MethodGSSAPI),
+	}); err != nil {
+		return nil, 0, nil, err
+	}
+	if g.Mechanism == nil {
+		gssutil.WriteAbort(conn)
+		return nil, 0, nil, errors.New("no GSS-API mechanism")
+	}
+	ctx, err := g.Mechanism.AcceptContext()
+	if err != nil {
+		gssutil.WriteAbort(conn)
+		return nil, 0, nil, err
+	}
+
+	// context establishment
+	for established := false; !established; {
+		token, err := gssutil.ReadMessage(conn, auth.GSSAPIAuthentication)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		var output []byte
+		output, established, err = ctx.Step(token)
+		if err != nil {
+			log.Printf("socks5: failed to establish GSS-API context: %v", err)
+			gssutil.WriteAbort(conn)
+			return nil, 0, nil, auth.ErrAuthenticationFailed
+		}
+		if err := gssutil.WriteMessage(conn, auth.GSSAPIAuthentication, output); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+
+	// protection level negotiation
+	token, err := gssutil.ReadMessage(conn, auth.GSSAPIProtection)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	msg, err := ctx.Unwrap(token)
+	if err != nil || len(msg) != 1 {
+		gssutil.WriteAbort(conn)
+		return nil, 0, nil, fmt.Errorf("invalid GSS-API protection level: %v", err)
+	}
+	level := auth.GSSProtectionLevel(msg[0])
+	if g.Protection != 0 {
+		level = g.Protection
+	}
+	if level < auth.GSSIntegrity || level > auth.GSSSelective {
+		gssutil.WriteAbort(conn)
+		return nil, 0, nil, fmt.Errorf("unsupported GSS-API protection level: %d", level)
+	}
+	token, err = ctx.Wrap([]byte{byte(level)}, false)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if err := gssutil.WriteMessage(conn, auth.GSSAPIProtection, token); err != nil {
+		return nil, 0, nil, err
+	}
+	return ctx, level, &auth.Identity{
+		Method: auth.MethodGSSAPI,
+		User:   ctx.PeerName(),
+	}, nil
+}
+
+// gssPacketConn returns the socket which relays the datagrams of UDP
+// ASSOCIATE encapsulated by the security context of conn. The socket is
+// opened for the association unless udpConn is dedicated to conn.
+func (s *Socks5) gssPacketConn(ctx context.Context, conn *gssutil.Conn, udpConn net.PacketConn) (net.PacketConn, error) {
+	if ws, ok := udpConn.(*wsPacketConn); ok {
+		return conn.PacketConn(ws), nil
+	}
+	pc, err := s.config.ListenPacket(ctx, "udp", "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	return conn.PacketConn(pc), nil
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxFailures = 5
+	defaultBaseDelay   = 100 * time.Millisecond
+	defaultMaxDelay    = 5 * time.Second
+	defaultBanDuration = 15 * time.Minute
+	defaultMaxTracked  = 100000
+)
+
+var (
+	errClientBanned = errors.New("client is banned by too many authentication failures")
+	errUserBanned   = errors.New("user is banned by too many authentication failures")
+)
+
+// AuthGuardConfig is the configuration of AuthGuard.
+type AuthGuardConfig struct {
+	// MaxFailures is the number of consecutive failures before a ban.
+	// 5 if zero.
+	MaxFailures int
+
+	// BaseDelay is the delay after the first failure, which is doubled
+	// on each failure up to MaxDelay. 100ms and 5s if zero.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// BanDuration is how long the client or user is banned. The failures
+	// are also forgotten after it. 15 minutes if zero.
+	BanDuration time.Duration
+
+	// MaxTracked is the number of client IP addresses and users whose
+	// failures are recorded at most. When it is reached, the expired
+	// records are forgotten, then the oldest records which are not
+	// banned, and then the bans which expire soonest. 100000 if zero.
+	MaxTracked int
+
+	// Allowlist is the networks of clients which are never delayed nor
+	// banned by their IP addresses.
+	Allowlist []*net.IPNet
+
+	// OnBan, if set, is called on each ban such as to count a metric.
+	// Bans are logged regardless.
+	OnBan func(Ban)
+}
+
+// A Ban represents a banned client IP address or user.
+type Ban struct {
+	IP       string // empty for the ban of user
+	User     string // empty for the ban of IP address
+	Failures int
+	Until    time.Time
+}
+
+// An AuthGuard protects authentication from brute-force attacks. The
+// failures of username/password are answered after a delay, which grows
+// exponentially by the failures of the client IP address or the user,
+// whichever is larger. The client IP addresses and the usernames are
+// banned temporarily after too many failures of any method.
+//
+// Banned clients are disconnected before the handshake. Banned users
+// fail to authenticate by username/password even with the right password.
+type AuthGuard struct {
+	config *AuthGuardConfig
+
+	mu     sync.Mutex
+	ips    map[string]*failures
+	users  map[string]*failures
+	pruned time.Time
+}
+
+type failures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// NewAuthGuard returns a new AuthGuard.
+func NewAuthGuard(c *AuthGuardConfig) *AuthGuard {
+	if c.MaxFailures <= 0 {
+		c.MaxFailures = defaultMaxFailures
+	}
+	if c.BaseDelay <= 0 {
+		c.BaseDelay = defaultBaseDelay
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = defaultMaxDelay
+	}
+	if c.BanDuration <= 0 {
+		c.BanDuration = defaultBanDuration
+	}
+	if c.MaxTracked <= 0 {
+		c.MaxTracked = defaultMaxTracked
+	}
+	return &AuthGuard{
+		config: c,
+		ips:    make(map[string]*failures),
+		users:  make(map[string]*failures),
+		pruned: time.Now(),
+	}
+}
+
+// Bans returns the current bans sorted by the expiry.
+func (g *AuthGuard) Bans() []Ban {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var bans []Ban
+	for ip, f := range g.ips {
+		if f.until.After(now) {
+			bans = append(bans, Ban{IP: ip, Failures: f.count, Until: f.until})
+		}
+	}
+	for user, f := range g.users {
+		if f.until.After(now) {
+			bans = append(bans, Ban{User: user, Failures: f.count, Until: f.until})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+// UnbanIP lifts the ban of the client IP address and forgets its failures.
+// It reports whether the address was tracked.
+func (g *AuthGuard) UnbanIP(ip string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.ips[ip]
+	delete(g.ips, ip)
+	return ok
+}
+
+// UnbanUser lifts the ban of the user and forgets its failures.
+// It reports whether the user was tracked.
+func (g *AuthGuard) UnbanUser(user string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.users[user]
+	delete(g.users, user)
+	return ok
+}
+
+// clientIP returns the IP address of the client, which is empty for
+// the clients in the allowlist or not connected by IP.
+func (g *AuthGuard) clientIP(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	for _, ipNet := range g.config.Allowlist {
+		if ipNet.Contains(tcpAddr.IP) {
+			return ""
+		}
+	}
+	return tcpAddr.IP.String()
+}
+
+// checkClient returns the error if the client is banned.
+func (g *AuthGuard) checkClient(addr net.Addr) error {
+	ip := g.clientIP(addr)
+	if ip == "" {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.banned(g.ips, ip) {
+		return errClientBanned
+	}
+	return nil
+}
+
+// failClient records a failure of the client.
+func (g *AuthGuard) failClient(addr net.Addr) {
+	if ip := g.clientIP(addr); ip != "" {
+		g.fail(g.ips, Ban{IP: ip})
+	}
+}
+
+func (g *AuthGuard) succeedClient(addr net.Addr) {
+	if ip := g.clientIP(addr); ip != "" {
+		g.mu.Lock()
+		delete(g.ips, ip)
+		g.mu.Unlock()
+	}
+}
+
+// banned must be called with g.mu held.
+func (g *AuthGuard) banned(m map[string]*failures, key string) bool {
+	f, ok := m[key]
+	return ok && f.until.After(time.Now())
+}
+
+// expired reports whether the failures are forgotten.
+func (g *AuthGuard) expired(f *failures, now time.Time) bool {
+	return now.Sub(f.last) > g.config.BanDuration && !f.until.After(now)
+}
+
+// prune forgets the expired records. It must be called with g.mu held.
+func (g *AuthGuard) prune(m map[string]*failures, now time.Time) {
+	for key, f := range m {
+		if g.expired(f, now) {
+			delete(m, key)
+		}
+	}
+}
+
+// evict makes room in the full map. It forgets the expired records, the
+// oldest records which are not banned and then the bans which expire
+// soonest until a tenth of MaxTracked is free. It must be called with
+// g.mu held.
+func (g *AuthGuard) evict(m map[string]*failures, now time.Time) {
+	g.prune(m, now)
+	target := g.config.MaxTracked - g.config.MaxTracked/10
+	if len(m) < target {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		fi, fj := m[keys[i]], m[keys[j]]
+		bi, bj := fi.until.After(now), fj.until.After(now)
+		switch {
+		case bi != bj:
+			return bj
+		case bi:
+			return fi.until.Before(fj.until)
+		}
+		return fi.last.Before(fj.last)
+	})
+	for _, key := range keys {
+		if len(m) < target {
+			break
+		}
+		delete(m, key)
+	}
+}
+
+// delay returns the delay after count failures.
+func (g *AuthGuard) delay(count int) time.Duration {
+	delay := g.config.BaseDelay << uint(count-1)
+	if delay > g.config.MaxDelay || delay <= 0 {
+		delay = g.config.MaxDelay
+	}
+	return delay
+}
+
+// fail records a failure, and returns the delay before answering it.
+func (g *AuthGuard) fail(m map[string]*failures, ban Ban) time.Duration {
+	key := ban.IP
+	if key == "" {
+		key = ban.User
+	}
+	now := time.Now()
+
+	g.mu.Lock()
+	if now.Sub(g.pruned) > g.config.BanDuration {
+		g.prune(g.ips, now)
+		g.prune(g.users, now)
+		g.pruned = now
+	}
+	f, ok := m[key]
+	if !ok || g.expired(f, now) {
+		if !ok && len(m) >= g.config.MaxTracked {
+			g.evict(m, now)
+		}
+		f = new(failures)
+		m[key] = f
+	}
+	f.count++
+	f.last = now
+	delay := g.delay(f.count)
+	banned := f.count >= g.config.MaxFailures && !f.until.After(now)
+	if banned {
+		f.until = now.Add(g.config.BanDuration)
+		ban.Failures, ban.Until = f.count, f.until
+	}
+	g.mu.Unlock()
+
+	if banned {
+		if ban.IP != "" {
+			log.Printf("socks5: banned client %s until %s after %d authentication failures", ban.IP, ban.Until.Format(time.RFC3339), ban.Failures)
+		} else {
+			log.Printf("socks5: banned user %q until %s after %d authentication failures", ban.User, ban.Until.Format(time.RFC3339), ban.Failures)
+		}
+		if g.config.OnBan != nil {
+			g.config.OnBan(ban)
+		}
+	}
+	return delay
+}
+
+// bannedUser reports whether the user is banned.
+func (g *AuthGuard) bannedUser(username string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.banned(g.users, username)
+}
+
+// succeedUser forgets the failures of the user.
+func (g *AuthGuard) succeedUser(username string) {
+	g.mu.Lock()
+	delete(g.users, username)
+	g.mu.Unlock()
+}
+
+// failUser records a failure of the user, and returns the delay before
+// answering it. It is the larger of the delays of the user and of the
+// client, whose failure is recorded by serveConn after the answer.
+func (g *AuthGuard) failUser(addr net.Addr, username string) time.Duration {
+	delay := g.fail(g.users, Ban{User: username})
+	ip := g.clientIP(addr)
+	if ip == "" {
+		return delay
+	}
+	now := time.Now()
+	g.mu.Lock()
+	count := 1
+	if f, ok := g.ips[ip]; ok && !g.expired(f, now) {
+		count = f.count + 1
+	}
+	g.mu.Unlock()
+	if d := g.delay(count); d > delay {
+		delay = d
+	}
+	return delay
+}
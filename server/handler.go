@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/address"
+	"github.com/Code-Hex/socks5/internal/connutil"
+)
+
+var errAlreadyReplied = errors.New("reply has already been sent")
+
+// A Handler responds to a SOCKS request.
+//
+// ServeSOCKS should send a reply through w before it relays any data.
+// If ServeSOCKS returns an error without sending a reply, the reply code
+// is chosen by the error and sent to the client.
+type Handler interface {
+	ServeSOCKS(ctx context.Context, w ResponseWriter, r *Request) error
+}
+
+// The HandlerFunc type is an adapter to allow the use of ordinary
+// functions as SOCKS handlers.
+type HandlerFunc func(ctx context.Context, w ResponseWriter, r *Request) error
+
+// ServeSOCKS calls f(ctx, w, r).
+func (f HandlerFunc) ServeSOCKS(ctx context.Context, w ResponseWriter, r *Request) error {
+	return f(ctx, w, r)
+}
+
+// A ResponseWriter is used by a Handler to reply to the request.
+// It is also the client connection, which is used to relay data
+// after the reply.
+type ResponseWriter interface {
+	net.Conn
+
+	// Reply sends the reply to the client. bind is used as BND.ADDR
+	// and BND.PORT, all zero address is sent if it is nil.
+	// Reply must be called only once.
+	Reply(status socks5.Reply, bind *address.Info) error
+
+	// Status returns the reply code which has been sent. replied is false
+	// if the reply has not been sent yet.
+	Status() (status socks5.Reply, replied bool)
+}
+
+type responseWriter struct {
+	*meteredConn
+	reply   func(w io.Writer, status socks5.Reply, bind *address.Info) error
+	status  socks5.Reply
+	replied bool
+}
+
+func (w *responseWriter) Reply(status socks5.Reply, bind *address.Info) error {
+	if w.replied {
+		return errAlreadyReplied
+	}
+	w.status, w.replied = status, true
+	return w.reply(w.Conn, status, bind)
+}
+
+func (w *responseWriter) Status() (socks5.Reply, bool) {
+	return w.status, w.replied
+}
+
+// meteredConn counts, shapes and limits by the quota the bytes relayed
+// for a request. The bytes read from the connection are upload.
+type meteredConn struct {
+	net.Conn
+	traffic *traffic
+	shape   *shape
+	quota   *quotaSession
+}
+
+func (w *meteredConn) Read(b []byte) (int, error) {
+	n, err := w.Conn.Read(b)
+	w.traffic.addUpload(n)
+	if qerr := w.quota.add(n); qerr != nil {
+		return n, qerr
+	}
+	if err == nil {
+		err = w.shape.waitUpload(n)
+	}
+	return n, err
+}
+
+func (w *meteredConn) Write(b []byte) (int, error) {
+	if err := w.shape.waitDownload(len(b)); err != nil {
+		return 0, err
+	}
+	n, err := w.Conn.Write(b)
+	w.traffic.addDownload(n)
+	if qerr := w.quota.add(n); qerr != nil && err == nil {
+		err = qerr
+	}
+	return n, err
+}
+
+func (w *meteredConn) CloseWrite() error {
+	return connutil.CloseWrite(w.Conn, nil)
+}
+
+// traffic counts bytes relayed for a request.
+type traffic struct {
+	upload, download int64
+}
+
+func (t *traffic) addUpload(n int) {
+	atomic.AddInt64(&t.upload, int64(n))
+}
+
+func (t *traffic) addDownload(n int) {
+	atomic.AddInt64(&t.download, int64(n))
+}
+
+// DefaultHandlers returns a new map of the built-in handlers.
+// It can be used to wrap the built-in handlers in Config.Handlers.
+func DefaultHandlers() map[socks5.Command]Handler {
+	return map[socks5.Command]Handler{
+		socks5.CmdConnect:      builtin((*Request).connect),
+		socks5.CmdBind:         builtin((*Request).bind),
+		socks5.CmdUDPAssociate: builtin((*Request).udpAssociate),
+		socks5.CmdResolve:      builtin((*Request).resolve),
+		socks5.CmdResolvePTR:   builtin((*Request).resolvePTR),
+	}
+}
+
+func builtin(f func(*Request, context.Context, ResponseWriter) error) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) error {
+		return f(r, ctx, w)
+	})
+}
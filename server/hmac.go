@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/auth"
+)
+
+var _ auth.IdentityAuthenticator = (*HMACSHA256)(nil)
+
+// HMACSHA256 authenticates the client by challenge-response with the
+// shared key, see auth.HMACSHA256Version for the protocol.
+type HMACSHA256 struct {
+	Keys auth.KeyStore
+}
+
+func (h *HMACSHA256) Authenticate(conn io.ReadWriter) error {
+	_, err := h.AuthenticateIdentity(conn)
+	return err
+}
+
+// AuthenticateIdentity authenticates the client, and returns the identity
+// which has the username.
+func (h *HMACSHA256) AuthenticateIdentity(conn io.ReadWriter) (*auth.Identity, error) {
+	nonce := make([]byte, auth.HMACSHA256NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, 3+len(nonce))
+	b = append(b, socks5.Version, byte(auth.MethodHMACSHA256), auth.HMACSHA256Version)
+	b = append(b, nonce...)
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != auth.HMACSHA256Version {
+		return nil, fmt.Errorf("unsupported hmac-sha256 version: %d", header[0])
+	}
+	username := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return nil, err
+	}
+	cnonce := make([]byte, auth.HMACSHA256NonceSize)
+	if _, err := io.ReadFull(conn, cnonce); err != nil {
+		return nil, err
+	}
+	mac := make([]byte, 32)
+	if _, err := io.ReadFull(conn, mac); err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	found := false
+	if h.Keys != nil {
+		key, found = h.Keys.Key(string(username))
+	}
+	if !found {
+		// computes the MAC anyway not to tell the unknown users by timing.
+		key = nonce
+	}
+	valid := hmac.Equal(mac, auth.HMACSHA256(key, nonce, cnonce, string(username))) && found
+
+	status := byte(0x01)
+	if valid {
+		status = 0x00
+	}
+	if _, err := conn.Write([]byte{auth.HMACSHA256Version, status}); err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, auth.ErrAuthenticationFailed
+	}
+	return &auth.Identity{
+		Method: auth.MethodHMACSHA256,
+		User:   string(username),
+	}, nil
+}
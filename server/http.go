@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/address"
+	"github.com/Code-Hex/socks5/auth"
+	"github.com/Code-Hex/socks5/internal/addrutil"
+)
+
+// hopHeaders are removed from the requests forwarded to the origin server.
+// See: https://tools.ietf.org/html/rfc7230#section-6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// serveHTTP serves a request of HTTP proxy. CONNECT request is handled
+// as SOCKS CONNECT command, the others are forwarded to the origin server
+// through the middlewares. The connection is closed after a request.
+func (s *Socks5) serveHTTP(ctx context.Context, conn net.Conn) error {
+	br := bufio.NewReader(conn)
+	hreq, err := http.ReadRequest(br)
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusBadRequest, nil)
+		return fmt.Errorf("failed to read http request: %v", err)
+	}
+	conn = &peekConn{Conn: conn, r: br}
+
+	id, err := s.authenticateHTTP(hreq, conn.RemoteAddr())
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusProxyAuthRequired, http.Header{
+			"Proxy-Authenticate": {`Basic realm="proxy"`},
+		})
+		return err
+	}
+
+	req, err := s.newHTTPRequest(hreq)
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusBadRequest, nil)
+		return err
+	}
+	if id != nil {
+		req.Identity = id
+		ctx = auth.NewContext(ctx, id)
+	}
+	if hreq.Method == http.MethodConnect {
+		return s.handle(ctx, conn, req, s.config.Handlers[req.Command])
+	}
+	return s.handle(ctx, conn, req, forwardHTTP(hreq))
+}
+
+// authenticateHTTP authenticates the client by Proxy-Authorization header.
+// Anonymous clients are accepted if MethodNotRequired is allowed.
+func (s *Socks5) authenticateHTTP(req *http.Request, addr net.Addr) (*auth.Identity, error) {
+	username, password, ok := proxyBasicAuth(req)
+	up, found := s.config.AuthMethods[auth.MethodUsernamePassword].(*UsernamePassword)
+	if found && ok && s.allowedMethod(addr, auth.MethodUsernamePassword) {
+		if !up.valid(addr, username, password) {
+			return nil, auth.ErrAuthenticationFailed
+		}
+		return up.identity(username), nil
+	}
+	if s.allowedMethod(addr, auth.MethodNotRequired) {
+		return nil, nil
+	}
+	return nil, auth.ErrAuthenticationFailed
+}
+
+func proxyBasicAuth(req *http.Request) (username, password string, ok bool) {
+	const prefix = "Basic "
+	v := req.Header.Get("Proxy-Authorization")
+	if len(v) < len(prefix) || !strings.EqualFold(v[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(v[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	i := strings.IndexByte(string(b), ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return string(b[:i]), string(b[i+1:]), true
+}
+
+func (s *Socks5) newHTTPRequest(hreq *http.Request) (*Request, error) {
+	hostport := hreq.Host
+	if hreq.Method != http.MethodConnect {
+		if hreq.URL.Scheme != "http" {
+			return nil, fmt.Errorf("unsupported scheme: %q", hreq.URL.Scheme)
+		}
+		hostport = hreq.URL.Host
+		if _, _, err := net.SplitHostPort(hostport); err != nil {
+			hostport = net.JoinHostPort(strings.Trim(hostport, "[]"), "80")
+		}
+	}
+	host, port, err := addrutil.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := addrInfoFromHostPort(host, port)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{
+		Command:  socks5.CmdConnect,
+		DestAddr: addr,
+
+		OriginalAddr: addr,
+
+		DialContext: s.config.DialContext,
+		Listen:      s.config.Listen,
+		Resolver:    s.config.Resolver,
+		IPPolicy:    s.config.IPPolicy,
+
+		replyFunc: replyHTTP(hreq.Method == http.MethodConnect),
+	}, nil
+}
+
+// forwardHTTP returns a handler which forwards req to the destination,
+// and relays the response.
+func forwardHTTP(req *http.Request) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) error {
+		target, err := r.DialContext(ctx, "tcp", r.DestAddr.String())
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+		if err := w.Reply(socks5.StatusSucceeded, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+
+		for _, h := range hopHeaders {
+			req.Header.Del(h)
+		}
+		req.Close = true
+		if err := req.Write(target); err != nil {
+			return err
+		}
+		_, err = io.Copy(w, target)
+		return err
+	})
+}
+
+// replyHTTP returns the function which replies to HTTP proxy clients.
+// Nothing is written on success of the forwarded requests since the
+// response of the origin server follows.
+func replyHTTP(connect bool) func(w io.Writer, status socks5.Reply, bind *address.Info) error {
+	return func(w io.Writer, status socks5.Reply, bind *address.Info) error {
+		if status != socks5.StatusSucceeded {
+			return writeHTTPStatus(w, httpStatusByReply(status), nil)
+		}
+		if !connect {
+			return nil
+		}
+		_, err := io.WriteString(w, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	}
+}
+
+// httpStatusByReply maps the reply code to the HTTP status code.
+func httpStatusByReply(status socks5.Reply) int {
+	switch status {
+	case socks5.StatusNotAllowedByRuleSet:
+		return http.StatusForbidden
+	case socks5.StatusTTLExpired:
+		return http.StatusGatewayTimeout
+	case socks5.StatusCommandNotSupported,
+		socks5.StatusAddrTypeNotSupported:
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadGateway
+}
+
+func writeHTTPStatus(w io.Writer, code int, header http.Header) error {
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Content-Length", "0")
+	header.Set("Connection", "close")
+	resp := "HTTP/1.1 " + strconv.Itoa(code) + " " + http.StatusText(code) + "\r\n"
+	if _, err := io.WriteString(w, resp); err != nil {
+		return err
+	}
+	if err := header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // for crypto.SHA256
+	_ "crypto/sha512" // for crypto.SHA384 and crypto.SHA512
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/auth"
+)
+
+// JWTConfig is the configuration of JWTVerifier.
+type JWTConfig struct {
+	// HMACKey is the key of HS256, HS384 and HS512 tokens.
+	HMACKey []byte
+
+	// JWKSFile is the path of the JSON Web Key Set which has the public
+	// keys of RS256, RS384, RS512, ES256, ES384 and ES512 tokens. The keys
+	// of "oct" type are used for HMAC. The key is selected by "kid"
+	// header if the token has it. The file is loaded once by
+	// NewJWTVerifier, create a new verifier to use the changed keys.
+	//
+	// The tokens of RS and ES are usually longer than 255 bytes, which
+	// JWT.PasswordField cannot carry. Use auth.MethodJWT for them.
+	JWKSFile string
+
+	// Audience, if set, must be in "aud" claim. Issuer, if set, must be
+	// "iss" claim.
+	Audience string
+	Issuer   string
+
+	// Claims are the claims which the tokens must have with the values.
+	Claims map[string]string
+
+	// UserClaim is the claim used as the username of the identity.
+	// "sub" if empty.
+	UserClaim string
+
+	// Leeway is the allowed clock skew for "exp" and "nbf" claims.
+	Leeway time.Duration
+}
+
+// A JWTVerifier validates the signature and the claims of JSON Web Tokens.
+// The tokens must have "exp" claim.
+type JWTVerifier struct {
+	config *JWTConfig
+	keys   []*jwk
+}
+
+type jwk struct {
+	kid string
+	key interface{} // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// NewJWTVerifier returns a new verifier. The JWKS file is loaded here.
+// c is copied, the changes after it returns are not used.
+func NewJWTVerifier(c *JWTConfig) (*JWTVerifier, error) {
+	config := *c
+	if config.UserClaim == "" {
+		config.UserClaim = "sub"
+	}
+	config.Claims = make(map[string]string, len(c.Claims))
+	for name, value := range c.Claims {
+		config.Claims[name] = value
+	}
+	c = &config
+	v := &JWTVerifier{config: c}
+	if len(c.HMACKey) > 0 {
+		v.keys = append(v.keys, &jwk{key: c.HMACKey})
+	}
+	if c.JWKSFile != "" {
+		b, err := ioutil.ReadFile(c.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := parseJWKS(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.JWKSFile, err)
+		}
+		v.keys = append(v.keys, keys...)
+	}
+	if len(v.keys) == 0 {
+		return nil, errors.New("no keys to verify tokens")
+	}
+	return v, nil
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// Verify validates the token and returns its claims.
+func (v *JWTVerifier) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	if len(header.Alg) != 5 {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	hash, ok := jwtHashes[header.Alg[2:]]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+	for _, k := range v.keys {
+		if header.Kid != "" && k.kid != "" && header.Kid != k.kid {
+			continue
+		}
+		if verifyJWTSignature(header.Alg[:2], hash, k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *JWTVerifier) validate(claims map[string]interface{}) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.config.Leeway)) {
+		return errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.config.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if aud := v.config.Audience; aud != "" {
+		found := false
+		switch got := claims["aud"].(type) {
+		case string:
+			found = got == aud
+		case []interface{}:
+			for _, a := range got {
+				if a == aud {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("unexpected audience %v", claims["aud"])
+		}
+	}
+	for name, want := range v.config.Claims {
+		if got, ok := claims[name].(string); !ok || got != want {
+			return fmt.Errorf("unexpected claim %s: %v", name, claims[name])
+		}
+	}
+	if _, ok := claims[v.config.UserClaim].(string); !ok {
+		return fmt.Errorf("token has no %s claim", v.config.UserClaim)
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifyJWTSignature(family string, hash crypto.Hash, key interface{}, signed, sig []byte) bool {
+	switch key := key.(type) {
+	case []byte:
+		if family != "HS" {
+			return false
+		}
+		mac := hmac.New(hash.New, key)
+		mac.Write(signed)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case *rsa.PublicKey:
+		if family != "RS" {
+			return false
+		}
+		h := hash.New()
+		h.Write(signed)
+		return rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if family != "ES" || len(sig) != 2*size {
+			return false
+		}
+		h := hash.New()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, h.Sum(nil), r, s)
+	}
+	return false
+}
+
+func parseJWKS(b []byte) ([]*jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			K   string `json:"k"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	decode := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	keys := make([]*jwk, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		key := &jwk{kid: k.Kid}
+		switch k.Kty {
+		case "oct":
+			b, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil || len(b) == 0 {
+				return nil, fmt.Errorf("invalid oct key %q", k.Kid)
+			}
+			key.key = b
+		case "RSA":
+			n, e := decode(k.N), decode(k.E)
+			if n.Sign() == 0 || !e.IsInt64() || e.Int64() < 3 {
+				return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+			}
+			key.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+			}
+			x, y := decode(k.X), decode(k.Y)
+			if !curve.IsOnCurve(x, y) {
+				return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			key.key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		default:
+			return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+var _ auth.IdentityAuthenticator = (*JWT)(nil)
+
+// JWT authenticates the client by JSON Web Token. The claims of the token
+// are the attributes of the identity, and the user is the claim of
+// JWTConfig.UserClaim.
+type JWT struct {
+	Verifier *JWTVerifier
+
+	// PasswordField reads the token from the password of username/password
+	// instead of auth.MethodJWT, so map it to auth.MethodUsernamePassword
+	// then. The username is ignored. Note the password is up to 255 bytes,
+	// which is too short for the tokens of RS and ES usually.
+	PasswordField bool
+}
+
+func (j *JWT) Authenticate(conn io.ReadWriter) error {
+	_, err := j.AuthenticateIdentity(conn)
+	return err
+}
+
+// AuthenticateIdentity authenticates the client, and returns the identity
+// which has the claims.
+func (j *JWT) AuthenticateIdentity(conn io.ReadWriter) (*auth.Identity, error) {
+	method := auth.MethodJWT
+	if j.PasswordField {
+		method = auth.MethodUsernamePassword
+	}
+	if _, err := conn.Write([]byte{socks5.Version, byte(method)}); err != nil {
+		return nil, err
+	}
+
+	var token string
+	if j.PasswordField {
+		_, password, err := readUsernamePassword(conn)
+		if err != nil {
+			return nil, err
+		}
+		token = password
+	} else {
+		header := make([]byte, 3)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, err
+		}
+		if header[0] != auth.JWTVersion {
+			return nil, fmt.Errorf("unsupported jwt version: %d", header[0])
+		}
+		b := make([]byte, int(binary.BigEndian.Uint16(header[1:])))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		token = string(b)
+	}
+
+	var claims map[string]interface{}
+	err := errors.New("no verifier")
+	if j.Verifier != nil {
+		claims, err = j.Verifier.Verify(token)
+	}
+	if err != nil {
+		log.Printf("socks5: invalid token: %v", err)
+	}
+	// same status as username/password.
+	if err := writeUsernamePasswordStatus(conn, err == nil); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, auth.ErrAuthenticationFailed
+	}
+	return &auth.Identity{
+		Method:     method,
+		User:       claims[j.Verifier.config.UserClaim].(string), // validated
+		Attributes: claims,
+	}, nil
+}
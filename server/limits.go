@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/socks5"
+)
+
+// Overflow represents the behaviour when the global session cap is reached.
+type Overflow int
+
+const (
+	// RejectOverflow replies StatusGeneralServerFailure to the request.
+	RejectOverflow Overflow = iota
+
+	// QueueOverflow waits for a session to end until QueueTimeout
+	// elapses, and then rejects the request.
+	QueueOverflow
+)
+
+const (
+	defaultQueueTimeout = 5 * time.Second
+
+	// maxRateEntries is the number of clients whose connection rate is
+	// tracked before the full buckets are swept.
+	maxRateEntries = 1024
+)
+
+var (
+	errTooManyConnections = errors.New("too many connections from the client")
+	errConnectionRate     = errors.New("connection rate exceeded")
+	errTooManySessions    = errors.New("too many sessions")
+)
+
+// Limits restricts the connections and sessions. Zero means unlimited.
+//
+// The limits keyed by the client address apply before the handshake,
+// and the connections are closed if they are exceeded. The others apply
+// after authentication, and StatusGeneralServerFailure is replied.
+type Limits struct {
+	// MaxConnectionsPerIP limits the concurrent connections per client
+	// IP address, or per subnet if the prefix lengths are set.
+	MaxConnectionsPerIP int
+
+	// ConnectionsPerSecondPerIP limits the new connections per client
+	// IP address, or per subnet if the prefix lengths are set.
+	ConnectionsPerSecondPerIP float64
+
+	// IPv4Prefix and IPv6Prefix group the client addresses into subnets
+	// such as 24 and 64. Each address is a group if zero.
+	IPv4Prefix int
+	IPv6Prefix int
+
+	// MaxSessionsPerUser limits the concurrent sessions per
+	// authenticated user.
+	MaxSessionsPerUser int
+
+	// MaxSessions limits the concurrent sessions in total. Overflow
+	// decides what happens to the request beyond it.
+	MaxSessions  int
+	Overflow     Overflow
+	QueueTimeout time.Duration // 5s if zero
+}
+
+type sessionLimiter struct {
+	limits   Limits
+	sessions chan struct{} // semaphore of MaxSessions, nil if unlimited
+
+	mu    sync.Mutex
+	conns map[string]int
+	users map[string]int
+	rates map[string]*connRate
+}
+
+type connRate struct {
+	tokens float64
+	last   time.Time
+}
+
+func newSessionLimiter(limits Limits) *sessionLimiter {
+	l := &sessionLimiter{
+		limits: limits,
+		conns:  make(map[string]int),
+		users:  make(map[string]int),
+		rates:  make(map[string]*connRate),
+	}
+	if limits.MaxSessions > 0 {
+		l.sessions = make(chan struct{}, limits.MaxSessions)
+	}
+	return l
+}
+
+// clientKey returns the subnet of the client. ok is false if the client
+// is not connected by IP.
+func (l *sessionLimiter) clientKey(addr net.Addr) (key string, ok bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return "", false
+	}
+	ip := tcpAddr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		if l.limits.IPv4Prefix > 0 {
+			return ip4.Mask(net.CIDRMask(l.limits.IPv4Prefix, 32)).String(), true
+		}
+		return ip4.String(), true
+	}
+	if l.limits.IPv6Prefix > 0 {
+		return ip.Mask(net.CIDRMask(l.limits.IPv6Prefix, 128)).String(), true
+	}
+	return ip.String(), true
+}
+
+// admitConn checks the limits keyed by the client address.
+// release must be called when the connection is closed.
+func (l *sessionLimiter) admitConn(addr net.Addr) (release func(), err error) {
+	key, ok := l.clientKey(addr)
+	if !ok || l.limits.MaxConnectionsPerIP <= 0 && l.limits.ConnectionsPerSecondPerIP <= 0 {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max := l.limits.MaxConnectionsPerIP; max > 0 && l.conns[key] >= max {
+		return nil, errTooManyConnections
+	}
+	if !l.allowRate(key, time.Now()) {
+		return nil, errConnectionRate
+	}
+	l.conns[key]++
+	return func() {
+		l.mu.Lock()
+		if l.conns[key]--; l.conns[key] <= 0 {
+			delete(l.conns, key)
+		}
+		l.mu.Unlock()
+	}, nil
+}
+
+// allowRate must be called with l.mu held.
+func (l *sessionLimiter) allowRate(key string, now time.Time) bool {
+	rate := l.limits.ConnectionsPerSecondPerIP
+	if rate <= 0 {
+		return true
+	}
+	burst := math.Max(1, math.Ceil(rate))
+	if len(l.rates) >= maxRateEntries {
+		for k, r := range l.rates {
+			if r.tokens+now.Sub(r.last).Seconds()*rate >= burst {
+				delete(l.rates, k)
+			}
+		}
+	}
+	r, ok := l.rates[key]
+	if !ok {
+		r = &connRate{tokens: burst, last: now}
+		l.rates[key] = r
+	}
+	r.tokens = math.Min(burst, r.tokens+now.Sub(r.last).Seconds()*rate)
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// acquireSession checks the limits of sessions. The error is replied
+// to the client. release must be called when the session ends.
+func (l *sessionLimiter) acquireSession(ctx context.Context, user string) (release func(), err error) {
+	releaseUser, err := l.acquireUser(user)
+	if err != nil {
+		return nil, err
+	}
+	if l.sessions == nil {
+		return releaseUser, nil
+	}
+
+	select {
+	case l.sessions <- struct{}{}:
+	default:
+		if l.limits.Overflow != QueueOverflow {
+			releaseUser()
+			return nil, newSessionLimitError(errTooManySessions)
+		}
+		timeout := l.limits.QueueTimeout
+		if timeout <= 0 {
+			timeout = defaultQueueTimeout
+		}
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case l.sessions <- struct{}{}:
+		case <-t.C:
+			releaseUser()
+			return nil, newSessionLimitError(errTooManySessions)
+		case <-ctx.Done():
+			releaseUser()
+			return nil, ctx.Err()
+		}
+	}
+	return func() {
+		<-l.sessions
+		releaseUser()
+	}, nil
+}
+
+func (l *sessionLimiter) acquireUser(user string) (release func(), err error) {
+	max := l.limits.MaxSessionsPerUser
+	if user == "" || max <= 0 {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.users[user] >= max {
+		return nil, newSessionLimitError(errTooManySessions)
+	}
+	l.users[user]++
+	return func() {
+		l.mu.Lock()
+		if l.users[user]--; l.users[user] <= 0 {
+			delete(l.users, user)
+		}
+		l.mu.Unlock()
+	}, nil
+}
+
+func newSessionLimitError(err error) error {
+	return &socks5.ReplyError{
+		Reply: socks5.StatusGeneralServerFailure,
+		Err:   err,
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Code-Hex/socks5/address"
+)
+
+// matcher matches destination addresses by a pattern.
+//
+// The pattern is one of:
+//
+//	"example.com"    the host (FQDN or IP address) exactly
+//	".example.com"   the domain and its subdomains, "*.example.com" is also accepted
+//	"10.0.0.0/8"     IP addresses in the CIDR
+//	""               any host
+//
+// If port is not zero, the destination port must also be equal.
+type matcher struct {
+	host   string
+	ip     net.IP
+	suffix string
+	ipNet  *net.IPNet
+	port   int
+}
+
+func newMatcher(pattern string, port int) (*matcher, error) {
+	if 0 > port || port > 0xffff {
+		return nil, fmt.Errorf("port number out of range: %d", port)
+	}
+	m := &matcher{port: port}
+	switch {
+	case pattern == "":
+	case strings.Contains(pattern, "/"):
+		_, ipNet, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return nil, err
+		}
+		m.ipNet = ipNet
+	case strings.HasPrefix(pattern, "*."):
+		m.suffix = strings.ToLower(pattern[1:])
+	case strings.HasPrefix(pattern, "."):
+		m.suffix = strings.ToLower(pattern)
+	default:
+		if ip := net.ParseIP(pattern); ip != nil {
+			m.ip = ip
+		} else {
+			m.host = strings.ToLower(pattern)
+		}
+	}
+	return m, nil
+}
+
+func (m *matcher) match(addr *address.Info) bool {
+	if m.port != 0 && m.port != addr.Port {
+		return false
+	}
+	switch addr.Type {
+	case address.TypeIPv4, address.TypeIPv6:
+		ip := net.IP(addr.Host)
+		switch {
+		case m.ip != nil:
+			return m.ip.Equal(ip)
+		case m.ipNet != nil:
+			return m.ipNet.Contains(ip)
+		}
+		return m.host == "" && m.suffix == ""
+	case address.TypeFQDN:
+		host := bytes.ToLower(addr.Host)
+		switch {
+		case m.host != "":
+			return m.host == string(host)
+		case m.suffix != "":
+			return bytes.HasSuffix(host, []byte(m.suffix)) ||
+				m.suffix[1:] == string(host)
+		}
+		return m.ip == nil && m.ipNet == nil
+	}
+	return false
+}
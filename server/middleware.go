@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"fmt"
+)
+
+// A Middleware wraps a Handler to add behaviour around request handling.
+//
+// A middleware can inspect and modify the Request before calling the next
+// handler, or return a *socks5.ReplyError without calling it to reject the
+// request with the specific reply code. After the next handler returns,
+// ResponseWriter.Status and Request.Traffic report the result.
+type Middleware func(next Handler) Handler
+
+// chain wraps h by middlewares. The first middleware is the outermost.
+func chain(middlewares []Middleware, h Handler) Handler {
+	h = replyOnError(h)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = replyOnError(middlewares[i](h))
+	}
+	return h
+}
+
+// replyOnError replies to the client if h returns an error without
+// replying, so that outer middlewares can observe the reply code.
+func replyOnError(h Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) error {
+		var err error
+		if h != nil {
+			err = h.ServeSOCKS(ctx, w, r)
+		} else {
+			err = ErrCommandNotSupported
+		}
+		if err != nil {
+			if _, replied := w.Status(); !replied {
+				if err := w.Reply(replyStatusByErr(err), nil); err != nil {
+					return fmt.Errorf("failed to reply: %v", err)
+				}
+			}
+		}
+		return err
+	})
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/auth"
+	"github.com/Code-Hex/socks5/internal/connutil"
+)
+
+// Balance represents how a Pool selects the upstream.
+type Balance int
+
+const (
+	// RoundRobin selects the upstreams in turn.
+	RoundRobin Balance = iota
+
+	// LeastConnections selects the upstream which has the fewest
+	// active connections.
+	LeastConnections
+
+	// HashDestination selects the upstream by consistent hashing on
+	// the destination host, so the same destination sticks to the
+	// same upstream.
+	HashDestination
+
+	// HashUser selects the upstream by consistent hashing on the
+	// authenticated user. The destination host is used for the
+	// anonymous clients.
+	HashUser
+)
+
+func (b Balance) String() string {
+	switch b {
+	case RoundRobin:
+		return "round robin"
+	case LeastConnections:
+		return "least connections"
+	case HashDestination:
+		return "hash destination"
+	case HashUser:
+		return "hash user"
+	}
+	return "unknown"
+}
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+
+	// virtual nodes per upstream in the hash ring.
+	virtualNodes = 100
+)
+
+var errNoUpstreams = errors.New("no upstreams in the pool")
+
+// PoolConfig is the configuration of Pool.
+type PoolConfig struct {
+	Upstreams []Upstream
+	Balance   Balance
+
+	// Optional.
+	ProxyDial           func(ctx context.Context, network, address string) (net.Conn, error)
+	HealthCheckInterval time.Duration // 10s if zero
+	HealthCheckTimeout  time.Duration // 5s if zero
+}
+
+// UpstreamStatus represents the state of an upstream in a Pool.
+type UpstreamStatus struct {
+	Upstream    Upstream
+	Up          bool
+	Active      int64 // the number of active connections
+	Failures    int64 // the number of failed dials in total
+	LastError   error
+	LastChecked time.Time
+}
+
+type poolMember struct {
+	active   int64 // accessed atomically, must be 64-bit aligned
+	failures int64
+	upstream Upstream
+
+	mu          sync.Mutex
+	up          bool
+	lastErr     error
+	lastChecked time.Time
+}
+
+func (m *poolMember) isUp() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.up
+}
+
+func (m *poolMember) setUp(up bool, err error) {
+	m.mu.Lock()
+	m.up, m.lastErr = up, err
+	m.lastChecked = time.Now()
+	m.mu.Unlock()
+}
+
+type ringNode struct {
+	hash   uint32
+	member *poolMember
+}
+
+// A Pool is a dialer which balances connections across upstream proxies.
+//
+// The upstreams which fail to dial are marked down, and the next one is
+// tried. The down upstreams are re-checked in background and marked up
+// when they respond again.
+type Pool struct {
+	next    uint64 // accessed atomically, must be 64-bit aligned
+	config  *PoolConfig
+	members []*poolMember
+	ring    []ringNode
+
+	onceClose sync.Once
+	done      chan struct{}
+}
+
+// NewPool returns a new Pool, which starts the health check in background.
+// Close stops it.
+func NewPool(c *PoolConfig) *Pool {
+	if c.HealthCheckInterval <= 0 {
+		c.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if c.HealthCheckTimeout <= 0 {
+		c.HealthCheckTimeout = defaultHealthCheckTimeout
+	}
+	if c.ProxyDial == nil {
+		var d net.Dialer
+		c.ProxyDial = d.DialContext
+	}
+	p := &Pool{
+		config: c,
+		done:   make(chan struct{}),
+	}
+	for _, u := range c.Upstreams {
+		m := &poolMember{upstream: u, up: true}
+		p.members = append(p.members, m)
+		for i := 0; i < virtualNodes; i++ {
+			p.ring = append(p.ring, ringNode{
+				hash:   crc32.ChecksumIEEE([]byte(u.Address + "#" + strconv.Itoa(i))),
+				member: m,
+			})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+	go p.healthCheck()
+	return p
+}
+
+// DialContext connects to the address on the named network through
+// one of the upstreams.
+func (p *Pool) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	candidates := p.candidates(ctx, address)
+	if len(candidates) == 0 {
+		return nil, errNoUpstreams
+	}
+	var firstErr error
+	for _, m := range candidates {
+		chain := &Chain{
+			Upstreams: []Upstream{m.upstream},
+			ProxyDial: p.config.ProxyDial,
+		}
+		atomic.AddInt64(&m.active, 1)
+		conn, err := chain.DialContext(ctx, network, address)
+		if err == nil {
+			return &poolConn{Conn: conn, member: m}, nil
+		}
+		atomic.AddInt64(&m.active, -1)
+
+		// The upstream is alive if it replies. e.g. the destination
+		// is unreachable from the upstream.
+		var replyErr *socks5.ReplyError
+		if errors.As(err, &replyErr) {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&m.failures, 1)
+		m.setUp(false, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// candidates returns the members in the order to try. The members
+// which are up come first, the down ones are tried as a last resort.
+func (p *Pool) candidates(ctx context.Context, address string) []*poolMember {
+	if len(p.members) == 0 {
+		return nil
+	}
+	var ordered []*poolMember
+	switch p.config.Balance {
+	case LeastConnections:
+		ordered = append(ordered, p.members...)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return atomic.LoadInt64(&ordered[i].active) < atomic.LoadInt64(&ordered[j].active)
+		})
+	case HashDestination, HashUser:
+		key, _, err := net.SplitHostPort(address)
+		if err != nil {
+			key = address
+		}
+		if id, ok := auth.FromContext(ctx); ok && p.config.Balance == HashUser {
+			key = id.User
+		}
+		ordered = p.walkRing(crc32.ChecksumIEEE([]byte(key)))
+	default:
+		n := atomic.AddUint64(&p.next, 1) - 1
+		start := int(n % uint64(len(p.members)))
+		ordered = append(ordered, p.members[start:]...)
+		ordered = append(ordered, p.members[:start]...)
+	}
+
+	up := make([]*poolMember, 0, len(ordered))
+	var down []*poolMember
+	for _, m := range ordered {
+		if m.isUp() {
+			up = append(up, m)
+		} else {
+			down = append(down, m)
+		}
+	}
+	return append(up, down...)
+}
+
+// walkRing returns the distinct members clockwise from hash.
+func (p *Pool) walkRing(hash uint32) []*poolMember {
+	start := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= hash
+	})
+	seen := make(map[*poolMember]bool, len(p.members))
+	ordered := make([]*poolMember, 0, len(p.members))
+	for i := 0; i < len(p.ring) && len(ordered) < len(p.members); i++ {
+		m := p.ring[(start+i)%len(p.ring)].member
+		if !seen[m] {
+			seen[m] = true
+			ordered = append(ordered, m)
+		}
+	}
+	return ordered
+}
+
+// Status returns the state of each upstream.
+func (p *Pool) Status() []UpstreamStatus {
+	status := make([]UpstreamStatus, 0, len(p.members))
+	for _, m := range p.members {
+		m.mu.Lock()
+		status = append(status, UpstreamStatus{
+			Upstream:    m.upstream,
+			Up:          m.up,
+			Active:      atomic.LoadInt64(&m.active),
+			Failures:    atomic.LoadInt64(&m.failures),
+			LastError:   m.lastErr,
+			LastChecked: m.lastChecked,
+		})
+		m.mu.Unlock()
+	}
+	return status
+}
+
+// Close stops the health check. Established connections are not closed.
+func (p *Pool) Close() error {
+	p.onceClose.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
+
+func (p *Pool) healthCheck() {
+	ticker := time.NewTicker(p.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		for _, m := range p.members {
+			if m.isUp() {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), p.config.HealthCheckTimeout)
+			err := p.check(ctx, m.upstream)
+			cancel()
+			m.setUp(err == nil, err)
+		}
+	}
+}
+
+// check ensures the upstream responds to the method negotiation.
+func (p *Pool) check(ctx context.Context, u Upstream) error {
+	network := u.Network
+	if network == "" {
+		network = "tcp"
+	}
+	conn, err := p.config.ProxyDial(ctx, network, u.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	method := auth.MethodNotRequired
+	if u.Username != "" {
+		method = auth.MethodUsernamePassword
+	}
+	if _, err := conn.Write([]byte{socks5.Version, 1, byte(method)}); err != nil {
+		return err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if b[0] != socks5.Version {
+		return fmt.Errorf("unexpected protocol version %d", b[0])
+	}
+	if auth.Method(b[1]) != method {
+		return auth.ErrUnSupportedMethod
+	}
+	return nil
+}
+
+// poolConn releases the active connection count of the upstream on Close.
+type poolConn struct {
+	net.Conn
+	member *poolMember
+	once   sync.Once
+}
+
+func (c *poolConn) CloseWrite() error {
+	return connutil.CloseWrite(c.Conn, c)
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.member.active, -1)
+	})
+	return c.Conn.Close()
+}
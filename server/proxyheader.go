@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/Code-Hex/socks5/address"
+)
+
+// ProxyHeaderVersion represents the version of PROXY protocol header.
+type ProxyHeaderVersion int
+
+const (
+	// ProxyHeaderV1 is the human-readable header.
+	ProxyHeaderV1 ProxyHeaderVersion = 1
+
+	// ProxyHeaderV2 is the binary header. The authenticated user is
+	// carried by TLV of PP2TypeUser, and the original destination
+	// specified by FQDN is carried by TLV of PP2_TYPE_AUTHORITY.
+	ProxyHeaderV2 ProxyHeaderVersion = 2
+)
+
+const (
+	pp2TypeAuthority = 0x02
+
+	// PP2TypeUser is the TLV type of PROXY protocol v2 header which
+	// carries the authenticated user name. It is in the custom range.
+	PP2TypeUser = 0xE0
+)
+
+// A ProxyHeaderRule sends PROXY protocol header to the destinations which
+// match. The header carries the address of the client and the destination.
+type ProxyHeaderRule struct {
+	// Match is the pattern of destination host, matched as in RewriteRule.
+	Match string
+
+	// Port restricts the rule to the destination port. Zero matches any port.
+	Port int
+
+	Version ProxyHeaderVersion
+}
+
+type proxyHeaderRule struct {
+	*matcher
+	version ProxyHeaderVersion
+}
+
+// A ProxyHeaderTable selects the version of PROXY protocol header sent on
+// the connections made by CONNECT command. The first rule which matches
+// is used, and no header is sent if none matches.
+//
+// It is safe for concurrent use, the rules can be replaced at runtime
+// by Reload.
+type ProxyHeaderTable struct {
+	mu    sync.RWMutex
+	rules []*proxyHeaderRule
+}
+
+// NewProxyHeaderTable returns a new table which has rules.
+func NewProxyHeaderTable(rules []ProxyHeaderRule) (*ProxyHeaderTable, error) {
+	t := new(ProxyHeaderTable)
+	if err := t.Reload(rules); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload replaces all rules as RewriteTable.Reload.
+func (t *ProxyHeaderTable) Reload(rules []ProxyHeaderRule) error {
+	parsed := make([]*proxyHeaderRule, 0, len(rules))
+	for _, rule := range rules {
+		switch rule.Version {
+		case ProxyHeaderV1, ProxyHeaderV2:
+		default:
+			return fmt.Errorf("unsupported PROXY protocol version: %d", rule.Version)
+		}
+		m, err := newMatcher(rule.Match, rule.Port)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, &proxyHeaderRule{
+			matcher: m,
+			version: rule.Version,
+		})
+	}
+	t.mu.Lock()
+	t.rules = parsed
+	t.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the version of the header for the destination.
+// ok is false if no rules match.
+func (t *ProxyHeaderTable) Lookup(addr *address.Info) (version ProxyHeaderVersion, ok bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, rule := range t.rules {
+		if rule.match(addr) {
+			return rule.version, true
+		}
+	}
+	return 0, false
+}
+
+// writeProxyHeader writes the header for the connection made by r.
+func (r *Request) writeProxyHeader(ctx context.Context, target net.Conn, version ProxyHeaderVersion) error {
+	src, _ := r.RemoteAddr.(*net.TCPAddr)
+	dst := r.proxyHeaderDest(ctx)
+
+	var buf bytes.Buffer
+	switch version {
+	case ProxyHeaderV1:
+		writeProxyV1(&buf, src, dst)
+	case ProxyHeaderV2:
+		var authority, user string
+		if r.OriginalAddr.Type == address.TypeFQDN {
+			authority = r.OriginalAddr.Host.String()
+		}
+		if r.Identity != nil {
+			user = r.Identity.User
+		}
+		writeProxyV2(&buf, src, dst, authority, user)
+	}
+	_, err := buf.WriteTo(target)
+	return err
+}
+
+// proxyHeaderDest returns the destination carried by the header, which is
+// the one requested by the client rather than rewritten if it is an IP
+// address. FQDN is resolved by Resolver since the remote address of the
+// connection is the upstream proxy if any. It is nil if unknown.
+func (r *Request) proxyHeaderDest(ctx context.Context) *net.TCPAddr {
+	addr := r.DestAddr
+	if r.OriginalAddr.Type != address.TypeFQDN {
+		addr = r.OriginalAddr
+	}
+	switch addr.Type {
+	case address.TypeIPv4, address.TypeIPv6:
+		return &net.TCPAddr{IP: net.IP(addr.Host), Port: addr.Port}
+	case address.TypeFQDN:
+		addrs, err := r.Resolver.LookupIPAddr(ctx, addr.Host.String())
+		if err != nil {
+			return nil
+		}
+		if ip := r.IPPolicy.choose(addrs); ip != nil {
+			return &net.TCPAddr{IP: ip, Port: addr.Port}
+		}
+	}
+	return nil
+}
+
+// writeProxyV1 writes "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n".
+// IPv4 address is mapped to IPv6 such as "::ffff:192.0.2.1" if the
+// families are mixed.
+func writeProxyV1(w io.Writer, src, dst *net.TCPAddr) {
+	if src == nil || dst == nil {
+		io.WriteString(w, "PROXY UNKNOWN\r\n")
+		return
+	}
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP != nil && dstIP != nil {
+		fmt.Fprintf(w, "PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, src.Port, dst.Port)
+		return
+	}
+	fmt.Fprintf(w, "PROXY TCP6 %s %s %d %d\r\n", proxyV1IPv6(src.IP), proxyV1IPv6(dst.IP), src.Port, dst.Port)
+}
+
+// proxyV1IPv6 formats ip in IPv6 form. net.IP.String formats IPv4-mapped
+// addresses in dotted form, which is not accepted for TCP6.
+func proxyV1IPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// writeProxyV2 writes the binary header with TLVs.
+func writeProxyV2(w *bytes.Buffer, src, dst *net.TCPAddr, authority, user string) {
+	const (
+		cmdLocal     = 0x20
+		cmdProxy     = 0x21
+		famUnspec    = 0x00
+		famTCPOverV4 = 0x11
+		famTCPOverV6 = 0x21
+	)
+	var (
+		cmd  byte = cmdProxy
+		fam  byte = famUnspec
+		body bytes.Buffer
+	)
+	switch {
+	case src == nil || dst == nil:
+		cmd = cmdLocal
+	case src.IP.To4() != nil && dst.IP.To4() != nil:
+		fam = famTCPOverV4
+		body.Write(src.IP.To4())
+		body.Write(dst.IP.To4())
+	default:
+		fam = famTCPOverV6
+		body.Write(src.IP.To16())
+		body.Write(dst.IP.To16())
+	}
+	if fam != famUnspec {
+		binary.Write(&body, binary.BigEndian, uint16(src.Port))
+		binary.Write(&body, binary.BigEndian, uint16(dst.Port))
+	}
+	writeTLV(&body, pp2TypeAuthority, authority)
+	writeTLV(&body, PP2TypeUser, user)
+
+	w.Write(proxyV2Signature)
+	w.WriteByte(cmd)
+	w.WriteByte(fam)
+	binary.Write(w, binary.BigEndian, uint16(body.Len()))
+	body.WriteTo(w)
+}
+
+func writeTLV(w *bytes.Buffer, typ byte, value string) {
+	if value == "" {
+		return
+	}
+	w.WriteByte(typ)
+	binary.Write(w, binary.BigEndian, uint16(len(value)))
+	w.WriteString(value)
+}
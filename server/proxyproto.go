@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Code-Hex/socks5/internal/connutil"
+)
+
+// See: https://www.haproxy.org/download/2.2/doc/proxy-protocol.txt
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	maxProxyV1Length   = 107
+	proxyHeaderTimeout = 5 * time.Second
+)
+
+var errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyConn is a connection whose remote address is conveyed by
+// PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r      io.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// NetConn returns the underlying connection.
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *proxyConn) CloseWrite() error {
+	return connutil.CloseWrite(c.Conn, nil)
+}
+
+// trustedProxy reports whether the connection comes from Config.TrustedProxies.
+func (s *Socks5) trustedProxy(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range s.config.TrustedProxies {
+		if ipNet.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+var errMissingProxyHeader = errors.New("missing PROXY protocol header")
+
+// readProxyHeader reads PROXY protocol v1 or v2 header, and returns the
+// connection whose RemoteAddr is the conveyed address. The connection
+// without the header is an error unless allowMissing is true.
+func readProxyHeader(conn net.Conn, allowMissing bool) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		remote net.Addr
+		found  bool
+	)
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		// It may be the method of HTTP such as "POST".
+		if prefix, err := br.Peek(len(proxyV1Prefix)); err == nil && bytes.Equal(prefix, proxyV1Prefix) {
+			found = true
+			remote, err = readProxyV1(br)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case proxyV2Signature[0]:
+		found = true
+		remote, err = readProxyV2(br)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !found && !allowMissing {
+		return nil, errMissingProxyHeader
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: br, remote: remote}, nil
+}
+
+// readProxyV1 reads the header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n".
+// nil address is returned for "UNKNOWN" protocol.
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxProxyV1Length {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidProxyHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 {
+		return nil, errInvalidProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol: %s", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the binary header. nil address is returned for
+// LOCAL command and the unsupported address families.
+//
+// +-----------+---------+-----+-----+---------+------+
+// | signature | ver_cmd | fam | len | address | TLVs |
+// +-----------+---------+-----+-----+---------+------+
+// |    12     |    1    |  1  |  2  |      len       |
+// +-----------+---------+-----+-----+---------+------+
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errInvalidProxyHeader
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	const (
+		cmdLocal = 0x0
+		cmdProxy = 0x1
+	)
+	switch header[12] & 0x0f {
+	case cmdLocal:
+		return nil, nil
+	case cmdProxy:
+	default:
+		return nil, errInvalidProxyHeader
+	}
+
+	const (
+		familyInet  = 0x1
+		familyInet6 = 0x2
+	)
+	switch header[13] >> 4 {
+	case familyInet:
+		if len(body) < 12 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:])),
+		}, nil
+	case familyInet6:
+		if len(body) < 36 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:])),
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/socks5"
+)
+
+const (
+	defaultQuotaFile          = "socks5-quota.json"
+	defaultQuotaFlushInterval = time.Minute
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaLimit is the number of bytes a user can relay per period.
+// Zero means unlimited.
+type QuotaLimit struct {
+	Daily   int64
+	Monthly int64
+}
+
+// QuotaUsage is the number of bytes relayed by a user in the periods.
+type QuotaUsage struct {
+	Day          string `json:"day"` // such as "2006-01-02"
+	DailyBytes   int64  `json:"daily_bytes"`
+	Month        string `json:"month"` // such as "2006-01"
+	MonthlyBytes int64  `json:"monthly_bytes"`
+}
+
+// A QuotaStore persists the usage of the users.
+type QuotaStore interface {
+	Load() (map[string]QuotaUsage, error)
+	Save(usage map[string]QuotaUsage) error
+}
+
+// FileQuotaStore is a QuotaStore which saves the usage to the JSON file.
+type FileQuotaStore struct {
+	Path string
+}
+
+// Load returns the usage saved in the file. It is empty if the file
+// does not exist.
+func (f *FileQuotaStore) Load() (map[string]QuotaUsage, error) {
+	usage := make(map[string]QuotaUsage)
+	b, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// Save replaces the file atomically.
+func (f *FileQuotaStore) Save(usage map[string]QuotaUsage) error {
+	b, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// QuotaConfig is the configuration of Quota.
+type QuotaConfig struct {
+	// Limit applies to every authenticated user. Users overrides it
+	// for the specific users.
+	Limit QuotaLimit
+	Users map[string]QuotaLimit
+
+	// CutActive closes the active sessions of the user who exceeds
+	// the quota. Otherwise only new requests are rejected.
+	CutActive bool
+
+	// Optional.
+	Store         QuotaStore     // FileQuotaStore of "socks5-quota.json" if nil
+	FlushInterval time.Duration  // 1 minute if zero
+	Location      *time.Location // time.Local if nil, used to start the periods
+}
+
+// A Quota counts the bytes relayed per authenticated user, including UDP
+// datagrams of UDP ASSOCIATE, and enforces the daily and monthly caps.
+// The requests of the users over the quota are replied with
+// StatusNotAllowedByRuleSet. Anonymous clients are not counted.
+//
+// The usage is saved to the store periodically and by Close.
+type Quota struct {
+	config *QuotaConfig
+
+	mu    sync.Mutex
+	usage map[string]QuotaUsage
+	dirty bool
+
+	// saveMu serializes Flush so that the snapshots are saved in order.
+	saveMu sync.Mutex
+
+	onceClose sync.Once
+	done      chan struct{}
+	flushed   chan struct{}
+}
+
+// NewQuota returns a new Quota which has the usage loaded from the store.
+func NewQuota(c *QuotaConfig) (*Quota, error) {
+	if c.Store == nil {
+		c.Store = &FileQuotaStore{Path: defaultQuotaFile}
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaultQuotaFlushInterval
+	}
+	if c.Location == nil {
+		c.Location = time.Local
+	}
+	usage, err := c.Store.Load()
+	if err != nil {
+		return nil, err
+	}
+	q := &Quota{
+		config:  c,
+		usage:   usage,
+		done:    make(chan struct{}),
+		flushed: make(chan struct{}),
+	}
+	go q.flushLoop()
+	return q, nil
+}
+
+// Usage returns the usage of the user in the current periods.
+func (q *Quota) Usage(user string) QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.current(user)
+}
+
+// Reset clears the usage of the user.
+func (q *Quota) Reset(user string) {
+	q.mu.Lock()
+	delete(q.usage, user)
+	q.dirty = true
+	q.mu.Unlock()
+}
+
+// Flush saves the usage to the store.
+func (q *Quota) Flush() error {
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	usage := make(map[string]QuotaUsage, len(q.usage))
+	for user, u := range q.usage {
+		usage[user] = u
+	}
+	q.dirty = false
+	q.mu.Unlock()
+
+	if err := q.config.Store.Save(usage); err != nil {
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Close stops the periodic flush and saves the usage.
+func (q *Quota) Close() error {
+	q.onceClose.Do(func() {
+		close(q.done)
+		<-q.flushed
+	})
+	return q.Flush()
+}
+
+func (q *Quota) flushLoop() {
+	defer close(q.flushed)
+	ticker := time.NewTicker(q.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+		}
+		if err := q.Flush(); err != nil {
+			log.Printf("socks5: failed to save quota: %v", err)
+		}
+	}
+}
+
+// current must be called with q.mu held.
+func (q *Quota) current(user string) QuotaUsage {
+	now := time.Now().In(q.config.Location)
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	u := q.usage[user]
+	if u.Day != day {
+		u.Day, u.DailyBytes = day, 0
+	}
+	if u.Month != month {
+		u.Month, u.MonthlyBytes = month, 0
+	}
+	return u
+}
+
+func (q *Quota) limit(user string) QuotaLimit {
+	if limit, ok := q.config.Users[user]; ok {
+		return limit
+	}
+	return q.config.Limit
+}
+
+func (l QuotaLimit) exceeded(u QuotaUsage) bool {
+	return l.Daily > 0 && u.DailyBytes >= l.Daily ||
+		l.Monthly > 0 && u.MonthlyBytes >= l.Monthly
+}
+
+// check returns the error replied to the user over the quota.
+func (q *Quota) check(user string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.limit(user).exceeded(q.current(user)) {
+		return &socks5.ReplyError{
+			Reply: socks5.StatusNotAllowedByRuleSet,
+			Err:   errQuotaExceeded,
+		}
+	}
+	return nil
+}
+
+// add counts n bytes. The error is returned if the session should be
+// cut since the user exceeds the quota.
+func (q *Quota) add(user string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.current(user)
+	u.DailyBytes += int64(n)
+	u.MonthlyBytes += int64(n)
+	q.usage[user] = u
+	q.dirty = true
+	if q.config.CutActive && q.limit(user).exceeded(u) {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// quotaSession counts the bytes of a session. The methods of nil
+// quotaSession do nothing.
+type quotaSession struct {
+	quota *Quota
+	user  string
+}
+
+func (s *quotaSession) add(n int) error {
+	if s == nil {
+		return nil
+	}
+	return s.quota.add(s.user, n)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -13,21 +14,62 @@ import (
 
 	"github.com/Code-Hex/socks5"
 	"github.com/Code-Hex/socks5/address"
+	"github.com/Code-Hex/socks5/auth"
 	"github.com/Code-Hex/socks5/internal/addrutil"
+	"github.com/Code-Hex/socks5/internal/connutil"
 	"golang.org/x/sync/errgroup"
 )
 
-var ErrCommandNotSupported = errors.New("command not supported")
+var (
+	ErrCommandNotSupported  = errors.New("command not supported")
+	ErrAddrTypeNotSupported = errors.New("address type not supported")
+)
 
 type Request struct {
+	// Version is socks5.Version or socks5.Socks4Version. It is zero
+	// for the requests from HTTP proxy clients.
 	Version  int
 	Command  socks5.Command
 	DestAddr *address.Info
 
+	// OriginalAddr is the destination requested by the client.
+	// DestAddr may be changed by Config.Rewrites or middlewares.
+	OriginalAddr *address.Info
+
+	// RemoteAddr is the address of the client. It is the address
+	// conveyed by PROXY protocol header if it is sent.
+	RemoteAddr net.Addr
+
+	// Identity is the authenticated client. It is nil if the
+	// authenticator does not report it. The identity is also stored
+	// in the context passed to handlers and DialContext.
+	Identity *auth.Identity
+
+	// UserID is USERID sent by SOCKS4 client. It is not authenticated.
+	UserID string
+
 	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
 	Listen      func(ctx context.Context, network, address string) (net.Listener, error)
+	Resolver    *net.Resolver
+	IPPolicy    IPPolicy
+
+	// ProxyHeaders selects PROXY protocol header sent by CONNECT command.
+	ProxyHeaders *ProxyHeaderTable
 
 	udpConn net.PacketConn
+	traffic traffic
+	shape   *shape
+	quota   *quotaSession
+
+	// replyFunc writes the reply of the protocol. reply is used if nil.
+	replyFunc func(w io.Writer, status socks5.Reply, bind *address.Info) error
+}
+
+// Traffic returns the number of bytes received from the client (upload)
+// and sent to the client (download) after the reply. UDP payloads
+// relayed for UDP ASSOCIATE are also counted.
+func (r *Request) Traffic() (upload, download int64) {
+	return atomic.LoadInt64(&r.traffic.upload), atomic.LoadInt64(&r.traffic.download)
 }
 
 // NewRequest returns request
@@ -58,35 +100,42 @@ func (s *Socks5) newRequest(s5conn io.Reader, udpConn net.PacketConn) (*Request,
 		Command:  socks5.Command(header[1]),
 		DestAddr: addr,
 
+		OriginalAddr: addr,
+
 		DialContext: s.config.DialContext,
 		Listen:      s.config.Listen,
+		Resolver:    s.config.Resolver,
+		IPPolicy:    s.config.IPPolicy,
 		udpConn:     udpConn,
 	}, nil
 }
 
-func (r *Request) do(ctx context.Context, s5conn net.Conn) (err error) {
-	switch r.Command {
-	case socks5.CmdConnect:
-		err = r.connect(ctx, s5conn)
-	case socks5.CmdBind:
-		err = r.bind(ctx, s5conn)
-	case socks5.CmdUDPAssociate:
-		err = r.udpAssociate(ctx, s5conn)
-	default:
-		err = ErrCommandNotSupported
+func (r *Request) do(ctx context.Context, s5conn net.Conn, h Handler) error {
+	w := &responseWriter{
+		meteredConn: r.meter(s5conn),
+		reply:       r.replyFunc,
 	}
+	if w.reply == nil {
+		w.reply = reply
+	}
+	return h.ServeSOCKS(ctx, w, r)
+}
 
-	if err != nil {
-		status := replyStatusByErr(err)
-		if err := reply(s5conn, status, nil); err != nil {
-			return fmt.Errorf("failed to reply: %v", err)
-		}
-		return err
+// meter returns conn which counts the bytes relayed for r.
+func (r *Request) meter(conn net.Conn) *meteredConn {
+	return &meteredConn{
+		Conn:    conn,
+		traffic: &r.traffic,
+		shape:   r.shape,
+		quota:   r.quota,
 	}
-	return nil
 }
 
 func replyStatusByErr(err error) socks5.Reply {
+	var replyErr *socks5.ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Reply
+	}
 	switch err := err.(type) {
 	case syscall.Errno:
 		switch err {
@@ -103,9 +152,14 @@ func replyStatusByErr(err error) socks5.Reply {
 		case syscall.EHOSTUNREACH:
 			return socks5.StatusHostUnreachable
 		}
+	case *net.DNSError:
+		return socks5.StatusHostUnreachable
 	default:
-		if err == ErrCommandNotSupported {
+		switch err {
+		case ErrCommandNotSupported:
 			return socks5.StatusCommandNotSupported
+		case ErrAddrTypeNotSupported:
+			return socks5.StatusAddrTypeNotSupported
 		}
 	}
 	return socks5.StatusGeneralServerFailure
@@ -162,22 +216,53 @@ func reply(s5conn io.Writer, reply socks5.Reply, addr *address.Info) error {
 	return err
 }
 
-func (r *Request) connect(ctx context.Context, s5conn net.Conn) error {
+// addrInfo converts addr to the address information used in replies.
+func addrInfo(addr net.Addr) (*address.Info, error) {
+	host, port, err := addrutil.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return addrInfoFromHostPort(host, port)
+}
+
+func addrInfoFromHostPort(hostStr string, port int) (*address.Info, error) {
+	aTyp, host, err := addrutil.GetAddressInfo(hostStr)
+	if err != nil {
+		return nil, err
+	}
+	return &address.Info{
+		Host: host,
+		Port: port,
+		Type: aTyp,
+	}, nil
+}
+
+func (r *Request) connect(ctx context.Context, w ResponseWriter) error {
 	target, err := r.DialContext(ctx, "tcp", r.DestAddr.String())
 	if err != nil {
 		return err
 	}
 	defer target.Close()
 
-	// TODO(codehex): it should pass the local address information?
-	if err := reply(s5conn, socks5.StatusSucceeded, nil); err != nil {
+	if r.ProxyHeaders != nil {
+		if version, ok := r.ProxyHeaders.Lookup(r.DestAddr); ok {
+			if err := r.writeProxyHeader(ctx, target, version); err != nil {
+				return err
+			}
+		}
+	}
+
+	// BND.ADDR and BND.PORT hold the local address of the established
+	// connection. If it cannot be represented, all zero address is sent.
+	bind, _ := addrInfo(target.LocalAddr())
+	if err := w.Reply(socks5.StatusSucceeded, bind); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
-	return transport(s5conn, target)
+	return transport(w, target)
 }
 
-func (r *Request) bind(ctx context.Context, s5conn net.Conn) error {
+func (r *Request) bind(ctx context.Context, w ResponseWriter) error {
 	target, err := r.DialContext(ctx, "tcp", r.DestAddr.String())
 	if err != nil {
 		return err
@@ -189,23 +274,12 @@ func (r *Request) bind(ctx context.Context, s5conn net.Conn) error {
 		return err
 	}
 
-	hostStr, port, err := addrutil.SplitHostPort(ln.Addr().String())
-	if err != nil {
-		return err
-	}
-
-	aTyp, host, err := addrutil.GetAddressInfo(hostStr)
+	bind, err := addrInfo(ln.Addr())
 	if err != nil {
 		return err
 	}
 
-	bind := &address.Info{
-		Host: host,
-		Port: port,
-		Type: aTyp,
-	}
-
-	if err := reply(s5conn, socks5.StatusSucceeded, bind); err != nil {
+	if err := w.Reply(socks5.StatusSucceeded, bind); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
@@ -218,7 +292,7 @@ func (r *Request) bind(ctx context.Context, s5conn net.Conn) error {
 			}
 			return err
 		}
-		return transport(target, c)
+		return transport(r.meter(c), target)
 	}
 }
 
@@ -226,10 +300,12 @@ func transport(dst, src io.ReadWriter) error {
 	var eg errgroup.Group
 	eg.Go(func() error {
 		_, err := io.Copy(dst, src)
+		connutil.CloseWrite(dst, nil)
 		return err
 	})
 	eg.Go(func() error {
 		_, err := io.Copy(src, dst)
+		connutil.CloseWrite(src, nil)
 		return err
 	})
 	return eg.Wait()
@@ -237,27 +313,13 @@ func transport(dst, src io.ReadWriter) error {
 
 const maxBufferSize = 1024
 
-func (r *Request) udpAssociate(ctx context.Context, s5conn net.Conn) error {
-
-	udpConnAddr := r.udpConn.LocalAddr()
-
-	hostStr, port, err := addrutil.SplitHostPort(udpConnAddr.String())
-	if err != nil {
-		return err
-	}
-
-	aTyp, host, err := addrutil.GetAddressInfo(hostStr)
+func (r *Request) udpAssociate(ctx context.Context, w ResponseWriter) error {
+	relay, err := addrInfo(r.udpConn.LocalAddr())
 	if err != nil {
 		return err
 	}
 
-	relay := &address.Info{
-		Host: host,
-		Port: port,
-		Type: aTyp,
-	}
-
-	if err := reply(s5conn, socks5.StatusSucceeded, relay); err != nil {
+	if err := w.Reply(socks5.StatusSucceeded, relay); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
@@ -274,6 +336,13 @@ func (r *Request) udpAssociate(ctx context.Context, s5conn net.Conn) error {
 		if err != nil {
 			return err
 		}
+		r.traffic.addUpload(len(buf))
+		if err := r.quota.add(len(buf)); err != nil {
+			return err
+		}
+		if err := r.shape.waitUpload(len(buf)); err != nil {
+			return err
+		}
 
 		dst := make([]byte, maxBufferSize)
 		nn, err := r.dialUDP(context.Background(), addr, buf, dst)
@@ -281,10 +350,17 @@ func (r *Request) udpAssociate(ctx context.Context, s5conn net.Conn) error {
 			return err
 		}
 
+		if err := r.shape.waitDownload(nn); err != nil {
+			return err
+		}
 		dest := udputil.CreateFrame(addr.Type, addr.Port, addr.Host, dst[:nn])
 		if _, err := r.udpConn.WriteTo(dest, remoteAddr); err != nil {
 			return err
 		}
+		r.traffic.addDownload(nn)
+		if err := r.quota.add(nn); err != nil {
+			return err
+		}
 	}
 }
 
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/address"
+)
+
+// resolve handles RESOLVE command. The resolved address is chosen by the
+// IPPolicy and returned in BND.ADDR.
+func (r *Request) resolve(ctx context.Context, w ResponseWriter) error {
+	var ip net.IP
+	switch r.DestAddr.Type {
+	case address.TypeIPv4, address.TypeIPv6:
+		ip = net.IP(r.DestAddr.Host)
+	case address.TypeFQDN:
+		addrs, err := r.Resolver.LookupIPAddr(ctx, r.DestAddr.Host.String())
+		if err != nil {
+			return err
+		}
+		ip = r.IPPolicy.choose(addrs)
+		if ip == nil {
+			return &net.DNSError{
+				Err:  "no suitable address found",
+				Name: r.DestAddr.Host.String(),
+			}
+		}
+	default:
+		return ErrAddrTypeNotSupported
+	}
+
+	bind := &address.Info{
+		Host: address.Host(ip.To16()),
+		Type: address.TypeIPv6,
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		bind.Host = address.Host(ip4)
+		bind.Type = address.TypeIPv4
+	}
+	if err := w.Reply(socks5.StatusSucceeded, bind); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+	return nil
+}
+
+// resolvePTR handles RESOLVE_PTR command. The first name is returned
+// in BND.ADDR.
+func (r *Request) resolvePTR(ctx context.Context, w ResponseWriter) error {
+	switch r.DestAddr.Type {
+	case address.TypeIPv4, address.TypeIPv6:
+	default:
+		return ErrAddrTypeNotSupported
+	}
+
+	ip := net.IP(r.DestAddr.Host).String()
+	names, err := r.Resolver.LookupAddr(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return &net.DNSError{
+			Err:  "no such host",
+			Name: ip,
+		}
+	}
+
+	name := strings.TrimSuffix(names[0], ".")
+	bind := &address.Info{
+		Host: address.Host(name),
+		Type: address.TypeFQDN,
+	}
+	if err := w.Reply(socks5.StatusSucceeded, bind); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+	return nil
+}
+
+// choose returns the first address which is allowed by the policy.
+// The preferred address family is returned when both are available.
+func (p IPPolicy) choose(addrs []net.IPAddr) net.IP {
+	var ip4, ip6 net.IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			if ip4 == nil {
+				ip4 = addr.IP
+			}
+		} else if ip6 == nil {
+			ip6 = addr.IP
+		}
+	}
+	switch p {
+	case IPv4Only:
+		return ip4
+	case IPv6Only:
+		return ip6
+	case PreferIPv4:
+		if ip4 != nil {
+			return ip4
+		}
+		return ip6
+	}
+	if ip6 != nil {
+		return ip6
+	}
+	return ip4
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Code-Hex/socks5/address"
+	"github.com/Code-Hex/socks5/internal/addrutil"
+)
+
+// A RewriteRule redirects the destinations which match to another address.
+type RewriteRule struct {
+	// Match is the pattern of destination host such as "example.com",
+	// ".example.com" for the domain and its subdomains, "10.0.0.0/8" or
+	// "" for any host. See matcher for the details.
+	Match string
+
+	// Port restricts the rule to the destination port. Zero matches any port.
+	Port int
+
+	// To is the new destination such as "10.1.2.3:8443".
+	// The original host is kept if host is omitted like ":2525", and the
+	// original port is kept if port is omitted like "10.1.2.3".
+	To string
+}
+
+type rewriteRule struct {
+	*matcher
+	host string
+	port int
+}
+
+// A RewriteTable rewrites destinations of requests before dialing.
+// The first rule which matches is applied.
+//
+// It is safe for concurrent use, the rules can be replaced at runtime
+// by Reload.
+type RewriteTable struct {
+	mu    sync.RWMutex
+	rules []*rewriteRule
+}
+
+// NewRewriteTable returns a new table which has rules.
+func NewRewriteTable(rules []RewriteRule) (*RewriteTable, error) {
+	t := new(RewriteTable)
+	if err := t.Reload(rules); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload replaces all rules. The rules are not changed if any of them is invalid.
+func (t *RewriteTable) Reload(rules []RewriteRule) error {
+	parsed := make([]*rewriteRule, 0, len(rules))
+	for _, rule := range rules {
+		r, err := parseRewriteRule(rule)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, r)
+	}
+	t.mu.Lock()
+	t.rules = parsed
+	t.mu.Unlock()
+	return nil
+}
+
+// Rewrite returns the rewritten address of addr. ok is false if
+// no rules match.
+func (t *RewriteTable) Rewrite(addr *address.Info) (_ *address.Info, ok bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, rule := range t.rules {
+		if !rule.match(addr) {
+			continue
+		}
+		rewritten := &address.Info{
+			Host: addr.Host,
+			Port: addr.Port,
+			Type: addr.Type,
+		}
+		if rule.host != "" {
+			// validated by parseRewriteRule
+			aTyp, host, _ := addrutil.GetAddressInfo(rule.host)
+			rewritten.Host, rewritten.Type = host, aTyp
+		}
+		if rule.port != 0 {
+			rewritten.Port = rule.port
+		}
+		return rewritten, true
+	}
+	return nil, false
+}
+
+func parseRewriteRule(rule RewriteRule) (*rewriteRule, error) {
+	m, err := newMatcher(rule.Match, rule.Port)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := splitRewriteTo(rule.To)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		if _, _, err := addrutil.GetAddressInfo(host); err != nil {
+			return nil, err
+		}
+	}
+	return &rewriteRule{
+		matcher: m,
+		host:    host,
+		port:    port,
+	}, nil
+}
+
+// splitRewriteTo splits "host:port", "host" or ":port".
+func splitRewriteTo(to string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(to)
+	if err != nil {
+		// IPv6 address without port such as "::1" or "[::1]".
+		if ip := net.ParseIP(strings.Trim(to, "[]")); ip != nil {
+			return ip.String(), 0, nil
+		}
+		if strings.Contains(to, ":") {
+			return "", 0, err
+		}
+		return to, 0, nil
+	}
+	if portStr == "" {
+		return host, 0, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	if 1 > port || port > 0xffff {
+		return "", 0, &net.AddrError{Err: "port number out of range", Addr: to}
+	}
+	return host, port, nil
+}
@@ -2,13 +2,18 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/Code-Hex/socks5"
 	"github.com/Code-Hex/socks5/auth"
+	"github.com/Code-Hex/socks5/internal/gssutil"
 )
 
 var ErrServerClosed = errors.New("socks5: Server closed")
@@ -16,10 +21,85 @@ var ErrServerClosed = errors.New("socks5: Server closed")
 type Config struct {
 	AuthMethods map[auth.Method]auth.Authenticator
 
-	// Optional.
+	// AuthPolicy selects the method among AuthMethods. By default, the
+	// first method offered by the client is selected.
+	AuthPolicy AuthPolicy
+
+	// Handlers maps commands to the handlers. Built-in handlers are
+	// used for the commands which are not in the map. To disable
+	// a command, map it to nil.
+	Handlers map[socks5.Command]Handler
+
+	// Middlewares wrap the handlers. The first one is the outermost.
+	Middlewares []Middleware
+
+	// Rewrites, if set, rewrites destinations of requests before
+	// they are handled.
+	Rewrites *RewriteTable
+
+	// Upstreams, if set, forwards connections made by DialContext, that
+	// is CONNECT and UDP ASSOCIATE, through the chain of upstream proxies.
+	// Routes, if set, selects the upstreams per destination instead.
+	// The destinations which match no routes use Upstreams.
+	Upstreams []Upstream
+	Routes    *RouteTable
+
+	// Optional. DialContext may be the method of HappyEyeballs, Chain,
+	// Pool, proxy.HTTPConnect or sshtunnel.Dialer.
 	DialContext  func(ctx context.Context, network, address string) (net.Conn, error)
 	Listen       func(ctx context.Context, network, address string) (net.Listener, error)
 	ListenPacket func(ctx context.Context, network, address string) (net.PacketConn, error)
+
+	// IPPolicy and Resolver are used by RESOLVE and RESOLVE_PTR commands,
+	// and the default DialContext, which dials FQDN destinations with
+	// Happy Eyeballs (RFC 8305).
+	IPPolicy IPPolicy
+	Resolver *net.Resolver
+
+	// EnableSOCKS4 accepts SOCKS4 and SOCKS4a clients on the same
+	// listener. Only CONNECT command is served for them, and only if
+	// MethodNotRequired is in AuthMethods because SOCKS4 has no
+	// authentication. DisableSOCKS5 rejects SOCKS5 clients.
+	EnableSOCKS4  bool
+	DisableSOCKS5 bool
+
+	// EnableHTTP accepts HTTP proxy clients on the same listener. CONNECT
+	// requests are served by the CONNECT handler, and the other requests
+	// with absolute URI such as "GET http://example.com/" are forwarded
+	// to the origin server. The credentials of UsernamePassword in
+	// AuthMethods are used for Proxy-Authorization Basic.
+	EnableHTTP bool
+
+	// TLSConfig is used by ServeTLS and ListenAndServeTLS. Set ClientAuth
+	// to verify client certificates for ClientCertificate authenticator.
+	TLSConfig *tls.Config
+
+	// TrustedProxies are the networks of load balancers which send
+	// PROXY protocol v1 or v2 header. The client address conveyed by the
+	// header replaces the remote address of the connection. The
+	// connections from them without the header are rejected unless
+	// AllowMissingProxyHeader is true, then the address of the proxy
+	// is used as the client address.
+	TrustedProxies          []*net.IPNet
+	AllowMissingProxyHeader bool
+
+	// ProxyHeaders, if set, sends PROXY protocol header to the destinations
+	// of CONNECT command, so that they know the address of the client.
+	ProxyHeaders *ProxyHeaderTable
+
+	// Shaper, if set, limits the bandwidth of the relayed data.
+	Shaper *Shaper
+
+	// Limits restricts the connections and sessions per client and in total.
+	Limits Limits
+
+	// Quota, if set, enforces the caps of bytes relayed per user.
+	Quota *Quota
+
+	// AuthGuard, if set, bans the clients and users which fail to
+	// authenticate repeatedly. The failures of UsernamePassword in
+	// AuthMethods are also delayed per client and per user.
+	AuthGuard *AuthGuard
 }
 
 func New(c *Config) *Socks5 {
@@ -31,11 +111,44 @@ func New(c *Config) *Socks5 {
 			auth.MethodNotRequired: &NotRequired{},
 		}
 	}
+	if c.AuthGuard != nil {
+		if up, ok := c.AuthMethods[auth.MethodUsernamePassword].(*UsernamePassword); ok {
+			// copies not to change the authenticator of the caller.
+			methods := make(map[auth.Method]auth.Authenticator, len(c.AuthMethods))
+			for m, a := range c.AuthMethods {
+				methods[m] = a
+			}
+			guarded := *up
+			guarded.guard = c.AuthGuard
+			methods[auth.MethodUsernamePassword] = &guarded
+			c.AuthMethods = methods
+		}
+	}
+	if c.Handlers == nil {
+		c.Handlers = make(map[socks5.Command]Handler)
+	}
+	for cmd, h := range DefaultHandlers() {
+		if _, ok := c.Handlers[cmd]; !ok {
+			c.Handlers[cmd] = h
+		}
+	}
+	if c.Resolver == nil {
+		c.Resolver = net.DefaultResolver
+	}
 	if c.DialContext == nil {
-		c.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
-			var d net.Dialer
-			return d.DialContext(ctx, network, address)
+		d := &HappyEyeballs{
+			Policy:   c.IPPolicy,
+			Resolver: c.Resolver,
 		}
+		c.DialContext = d.DialContext
+	}
+	if len(c.Upstreams) > 0 || c.Routes != nil {
+		d := &upstreamDialer{
+			dialContext: c.DialContext,
+			upstreams:   c.Upstreams,
+			routes:      c.Routes,
+		}
+		c.DialContext = d.DialContext
 	}
 	if c.Listen == nil {
 		c.Listen = func(ctx context.Context, network, address string) (net.Listener, error) {
@@ -51,13 +164,17 @@ func New(c *Config) *Socks5 {
 	}
 	return &Socks5{
 		config:      c,
+		methodOrder: auth.MethodOrder(c.AuthPolicy.Order, c.AuthMethods),
+		limiter:     newSessionLimiter(c.Limits),
 		shutdown:    make(chan struct{}),
 		waitingDone: make(chan struct{}),
 	}
 }
 
 type Socks5 struct {
-	config *Config
+	config      *Config
+	methodOrder []auth.Method
+	limiter     *sessionLimiter
 
 	onceShutdown sync.Once
 	shutdown     chan struct{}
@@ -75,8 +192,40 @@ func (s *Socks5) ListenAndServe(network, addr string) error {
 	return s.Serve(l)
 }
 
+// ListenAndServeTLS is used to create a TLS listener and serve on it.
+// certFile and keyFile may be empty if Config.TLSConfig has certificates.
+func (s *Socks5) ListenAndServeTLS(network, addr, certFile, keyFile string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(l, certFile, keyFile)
+}
+
+// ServeTLS is used to serve TLS connections from a listener. UDP
+// datagrams relayed for UDP ASSOCIATE are not encrypted.
+func (s *Socks5) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config := new(tls.Config)
+	if s.config.TLSConfig != nil {
+		config = s.config.TLSConfig.Clone()
+	}
+	configHasCert := len(config.Certificates) > 0 || config.GetCertificate != nil
+	if !configHasCert || certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return s.serve(l, config)
+}
+
 // Serve is used to serve connections from a listener
 func (s *Socks5) Serve(l net.Listener) error {
+	return s.serve(l, nil)
+}
+
+func (s *Socks5) serve(l net.Listener, tlsConfig *tls.Config) error {
 	ctx := context.Background()
 
 	// for udp associate
@@ -115,7 +264,7 @@ func (s *Socks5) Serve(l net.Listener) error {
 
 		udpConn := udpConn // To avoid race condition
 		go func() {
-			if err := s.serveConn(ctx, conn, udpConn); err != nil {
+			if err := s.serveTCP(ctx, conn, udpConn, tlsConfig); err != nil {
 				log.Printf("socks5: error(tcp) %v", err)
 			}
 			log.Println("done tcp serve")
@@ -139,21 +288,127 @@ func (s *Socks5) Shutdown(ctx context.Context) error {
 	return nil
 }
 
-func (s *Socks5) serveConn(ctx context.Context, conn net.Conn, udpConn net.PacketConn) error {
+// serveTCP reads PROXY protocol header from the trusted proxies, and
+// starts TLS if tlsConfig is not nil before serving conn.
+func (s *Socks5) serveTCP(ctx context.Context, conn net.Conn, udpConn net.PacketConn, tlsConfig *tls.Config) error {
+	if s.trustedProxy(conn) {
+		c, err := readProxyHeader(conn, s.config.AllowMissingProxyHeader)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		conn = c
+	}
+	if tlsConfig != nil {
+		conn = tls.Server(conn, tlsConfig)
+	}
+	return s.serveConn(ctx, conn, udpConn)
+}
+
+// serveConn serves a connection. udpConn relays UDP ASSOCIATE.
+func (s *Socks5) serveConn(ctx context.Context, conn net.Conn, udpConn net.PacketConn) (err error) {
 	s.wg.Add(1)
 	defer func() {
 		s.wg.Done()
 		conn.Close()
 	}()
 
-	if err := s.authenticate(conn); err != nil {
+	release, err := s.limiter.admitConn(conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if guard := s.config.AuthGuard; guard != nil {
+		if err := guard.checkClient(conn.RemoteAddr()); err != nil {
+			return err
+		}
+		defer func() {
+			if errors.Is(err, auth.ErrAuthenticationFailed) {
+				guard.failClient(conn.RemoteAddr())
+			}
+		}()
+	}
+
+	if s.config.EnableSOCKS4 || s.config.DisableSOCKS5 || s.config.EnableHTTP {
+		version := make([]byte, 1)
+		if _, err := io.ReadFull(conn, version); err != nil {
+			return fmt.Errorf("failed to get version: %v", err)
+		}
+		conn = newPeekConn(conn, version)
+		switch {
+		case version[0] == socks5.Socks4Version && s.config.EnableSOCKS4:
+			return s.serveSocks4(ctx, conn)
+		case 'A' <= version[0] && version[0] <= 'Z' && s.config.EnableHTTP:
+			return s.serveHTTP(ctx, conn)
+		case version[0] == socks5.Version && !s.config.DisableSOCKS5:
+		default:
+			return fmt.Errorf("unsupported version: %d", version[0])
+		}
+	}
+
+	authConn, id, err := s.authenticate(conn)
+	if err != nil {
 		return err
 	}
+	conn = authConn
 
 	req, err := s.newRequest(conn, udpConn)
 	if err != nil {
 		return err
 	}
+	if gc, ok := conn.(*gssutil.Conn); ok && req.Command == socks5.CmdUDPAssociate {
+		pc, err := s.gssPacketConn(ctx, gc, udpConn)
+		if err != nil {
+			return err
+		}
+		defer pc.Close()
+		req.udpConn = pc
+	}
+	if id != nil {
+		req.Identity = id
+		ctx = auth.NewContext(ctx, id)
+	}
+	return s.handle(ctx, conn, req, s.config.Handlers[req.Command])
+}
+
+// handle serves the request by h wrapped in the middlewares.
+func (s *Socks5) handle(ctx context.Context, conn net.Conn, req *Request, h Handler) error {
+	req.RemoteAddr = conn.RemoteAddr()
+	if s.config.AuthGuard != nil {
+		s.config.AuthGuard.succeedClient(req.RemoteAddr)
+	}
+	req.ProxyHeaders = s.config.ProxyHeaders
+
+	var user string
+	if req.Identity != nil {
+		user = req.Identity.User
+	}
+	release, err := s.limiter.acquireSession(ctx, user)
+	if err != nil {
+		h = HandlerFunc(func(context.Context, ResponseWriter, *Request) error {
+			return err
+		})
+	} else {
+		defer release()
+	}
+	if s.config.Quota != nil && user != "" {
+		if err := s.config.Quota.check(user); err != nil {
+			h = HandlerFunc(func(context.Context, ResponseWriter, *Request) error {
+				return err
+			})
+		}
+		req.quota = &quotaSession{quota: s.config.Quota, user: user}
+	}
+	if s.config.Rewrites != nil {
+		if addr, ok := s.config.Rewrites.Rewrite(req.DestAddr); ok {
+			req.DestAddr = addr
+		}
+	}
+	if s.config.Shaper != nil {
+		req.shape = s.config.Shaper.acquire(ctx, user, req.RemoteAddr, req.DestAddr)
+		defer req.shape.release()
+	}
 
-	return req.do(ctx, conn)
+	return req.do(ctx, conn, chain(s.config.Middlewares, h))
 }
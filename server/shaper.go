@@ -0,0 +1,363 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/socks5/address"
+)
+
+// Bandwidth is the limit of throughput in bytes per second.
+// Zero means unlimited.
+type Bandwidth struct {
+	Upload   int64 // from the client to the destination
+	Download int64 // from the destination to the client
+}
+
+// Throughput is the number of bytes relayed in the last second.
+type Throughput struct {
+	Upload   int64
+	Download int64
+}
+
+// A BandwidthRule limits the throughput to the destinations which match
+// in total.
+type BandwidthRule struct {
+	// Match is the pattern of destination host, matched as in RewriteRule.
+	Match string
+
+	// Port restricts the rule to the destination port. Zero matches any port.
+	Port int
+
+	Bandwidth Bandwidth
+}
+
+// ShaperConfig is the configuration of Shaper. Every limit which applies
+// to a session is enforced, the most restrictive one wins.
+type ShaperConfig struct {
+	// Global limits the throughput of all sessions in total.
+	Global Bandwidth
+
+	// PerUser limits the throughput of each authenticated user.
+	// Users overrides it for the specific users.
+	PerUser Bandwidth
+	Users   map[string]Bandwidth
+
+	// PerIP limits the throughput of each client IP address.
+	PerIP Bandwidth
+
+	// Rules limit the throughput per destination. The first rule
+	// which matches is applied.
+	Rules []BandwidthRule
+}
+
+// ShaperStats is the current throughput observed by Shaper.
+type ShaperStats struct {
+	Global Throughput
+	Users  map[string]Throughput
+	IPs    map[string]Throughput
+	Rules  []Throughput // in the order of ShaperConfig.Rules
+}
+
+// A Shaper limits the bandwidth of the relayed data by token buckets,
+// including UDP datagrams of UDP ASSOCIATE.
+//
+// It is safe for concurrent use. The limits can be changed at runtime by
+// Reload, and they apply to the active sessions as well. Only the
+// changes of Rules apply to new sessions.
+type Shaper struct {
+	mu     sync.Mutex
+	config ShaperConfig
+	global *bucketPair
+	users  map[string]*bucketPair
+	ips    map[string]*bucketPair
+	rules  []*bandwidthRule
+}
+
+type bandwidthRule struct {
+	*matcher
+	buckets *bucketPair
+}
+
+// NewShaper returns a new Shaper.
+func NewShaper(c *ShaperConfig) (*Shaper, error) {
+	s := &Shaper{
+		global: newBucketPair(Bandwidth{}),
+		users:  make(map[string]*bucketPair),
+		ips:    make(map[string]*bucketPair),
+	}
+	if err := s.Reload(c); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload replaces the limits. They are not changed if any of the rules is invalid.
+func (s *Shaper) Reload(c *ShaperConfig) error {
+	rules := make([]*bandwidthRule, 0, len(c.Rules))
+	for _, rule := range c.Rules {
+		m, err := newMatcher(rule.Match, rule.Port)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, &bandwidthRule{
+			matcher: m,
+			buckets: newBucketPair(rule.Bandwidth),
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = *c
+	s.rules = rules
+	s.global.setLimit(c.Global)
+	for user, b := range s.users {
+		b.setLimit(s.userLimit(user))
+	}
+	for _, b := range s.ips {
+		b.setLimit(c.PerIP)
+	}
+	return nil
+}
+
+func (s *Shaper) userLimit(user string) Bandwidth {
+	if bw, ok := s.config.Users[user]; ok {
+		return bw
+	}
+	return s.config.PerUser
+}
+
+// Stats returns the current throughput.
+func (s *Shaper) Stats() ShaperStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := ShaperStats{
+		Global: s.global.throughput(),
+		Users:  make(map[string]Throughput, len(s.users)),
+		IPs:    make(map[string]Throughput, len(s.ips)),
+		Rules:  make([]Throughput, 0, len(s.rules)),
+	}
+	for user, b := range s.users {
+		stats.Users[user] = b.throughput()
+	}
+	for ip, b := range s.ips {
+		stats.IPs[ip] = b.throughput()
+	}
+	for _, rule := range s.rules {
+		stats.Rules = append(stats.Rules, rule.buckets.throughput())
+	}
+	return stats
+}
+
+// acquire returns the limits which apply to the session.
+// release must be called when the session ends.
+func (s *Shaper) acquire(ctx context.Context, user string, remote net.Addr, dest *address.Info) *shape {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh := &shape{
+		ctx:     ctx,
+		shaper:  s,
+		buckets: []*bucketPair{s.global},
+	}
+	if user != "" {
+		b, ok := s.users[user]
+		if !ok {
+			b = newBucketPair(s.userLimit(user))
+			s.users[user] = b
+		}
+		b.refs++
+		sh.user = user
+		sh.buckets = append(sh.buckets, b)
+	}
+	if addr, ok := remote.(*net.TCPAddr); ok {
+		ip := addr.IP.String()
+		b, ok := s.ips[ip]
+		if !ok {
+			b = newBucketPair(s.config.PerIP)
+			s.ips[ip] = b
+		}
+		b.refs++
+		sh.ip = ip
+		sh.buckets = append(sh.buckets, b)
+	}
+	for _, rule := range s.rules {
+		if rule.match(dest) {
+			sh.buckets = append(sh.buckets, rule.buckets)
+			break
+		}
+	}
+	return sh
+}
+
+func (s *Shaper) release(sh *shape) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.users[sh.user]; ok && sh.user != "" {
+		if b.refs--; b.refs == 0 {
+			delete(s.users, sh.user)
+		}
+	}
+	if b, ok := s.ips[sh.ip]; ok && sh.ip != "" {
+		if b.refs--; b.refs == 0 {
+			delete(s.ips, sh.ip)
+		}
+	}
+}
+
+// shape is the limits applied to a session. The methods of nil shape
+// do nothing.
+type shape struct {
+	ctx     context.Context
+	shaper  *Shaper
+	user    string
+	ip      string
+	buckets []*bucketPair
+}
+
+func (sh *shape) waitUpload(n int) error {
+	if sh == nil {
+		return nil
+	}
+	for _, b := range sh.buckets {
+		if err := b.upload.wait(sh.ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *shape) waitDownload(n int) error {
+	if sh == nil {
+		return nil
+	}
+	for _, b := range sh.buckets {
+		if err := b.download.wait(sh.ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *shape) release() {
+	if sh != nil {
+		sh.shaper.release(sh)
+	}
+}
+
+type bucketPair struct {
+	upload, download *bucket
+	refs             int // guarded by Shaper.mu
+}
+
+func newBucketPair(bw Bandwidth) *bucketPair {
+	return &bucketPair{
+		upload:   newBucket(bw.Upload),
+		download: newBucket(bw.Download),
+	}
+}
+
+func (b *bucketPair) setLimit(bw Bandwidth) {
+	b.upload.setRate(bw.Upload)
+	b.download.setRate(bw.Download)
+}
+
+func (b *bucketPair) throughput() Throughput {
+	return Throughput{
+		Upload:   b.upload.throughput(),
+		Download: b.download.throughput(),
+	}
+}
+
+// bucket is a token bucket which holds the tokens of a second at most.
+// The bytes beyond the tokens are borrowed, and the caller waits until
+// they are paid back.
+type bucket struct {
+	mu     sync.Mutex
+	rate   int64 // bytes per second, zero is unlimited
+	tokens float64
+	last   time.Time
+
+	// throughput of the last second
+	second  int64
+	current int64
+	prev    int64
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (b *bucket) setRate(rate int64) {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.rate = rate
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.mu.Unlock()
+}
+
+// refill must be called with b.mu held.
+func (b *bucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+		if max := float64(b.rate); b.tokens > max {
+			b.tokens = max
+		}
+	}
+	b.last = now
+}
+
+// observe must be called with b.mu held.
+func (b *bucket) observe(now time.Time, n int64) {
+	switch sec := now.Unix(); {
+	case sec == b.second:
+	case sec == b.second+1:
+		b.second, b.prev, b.current = sec, b.current, 0
+	default:
+		b.second, b.prev, b.current = sec, 0, 0
+	}
+	b.current += n
+}
+
+func (b *bucket) throughput() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.observe(time.Now(), 0)
+	return b.prev
+}
+
+func (b *bucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.observe(now, int64(n))
+	if b.rate == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	b.refill(now)
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
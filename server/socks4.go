@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/address"
+	"github.com/Code-Hex/socks5/auth"
+	"github.com/Code-Hex/socks5/internal/connutil"
+)
+
+// maxSocks4Field is the maximum length of USERID and the hostname of SOCKS4a.
+const maxSocks4Field = 255
+
+var errSocks4FieldTooLong = errors.New("socks4: field is too long")
+
+// newSocks4Request reads SOCKS4 or SOCKS4a request.
+//
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+// | VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+// | 1  | 1  |    2    |         4         | variable     | 1  |
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+//
+// SOCKS4a sets DSTIP to 0.0.0.x (x is not zero), and the hostname
+// terminated by NULL follows USERID.
+func (s *Socks5) newSocks4Request(conn io.Reader) (*Request, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("failed to get header information: %v", err)
+	}
+	if header[0] != socks5.Socks4Version {
+		return nil, fmt.Errorf("unsupported version: %d", header[0])
+	}
+
+	userID, err := readNullTerminated(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := &address.Info{
+		Host: address.Host(header[4:8]),
+		Port: int(header[2])<<8 | int(header[3]),
+		Type: address.TypeIPv4,
+	}
+	if ip := header[4:8]; ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err := readNullTerminated(conn)
+		if err != nil {
+			return nil, err
+		}
+		addr.Host, addr.Type = address.Host(host), address.TypeFQDN
+	}
+
+	return &Request{
+		Version:  socks5.Socks4Version,
+		Command:  socks5.Command(header[1]),
+		DestAddr: addr,
+		UserID:   string(userID),
+
+		OriginalAddr: addr,
+
+		DialContext: s.config.DialContext,
+		Listen:      s.config.Listen,
+		Resolver:    s.config.Resolver,
+		IPPolicy:    s.config.IPPolicy,
+
+		replyFunc: reply4,
+	}, nil
+}
+
+func readNullTerminated(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if b[0] == 0 {
+			return buf.Bytes(), nil
+		}
+		if buf.Len() == maxSocks4Field {
+			return nil, errSocks4FieldTooLong
+		}
+		buf.WriteByte(b[0])
+	}
+}
+
+// serveSocks4 serves SOCKS4 and SOCKS4a. Only CONNECT command is
+// accepted. BIND is rejected since SOCKS4 clients wait for the second
+// reply when the peer connects, which the bind handler does not send.
+func (s *Socks5) serveSocks4(ctx context.Context, conn net.Conn) error {
+	req, err := s.newSocks4Request(conn)
+	if err != nil {
+		return err
+	}
+	// SOCKS4 has no authentication, so it is served only for the
+	// clients which may skip it.
+	if !s.allowedMethod(conn.RemoteAddr(), auth.MethodNotRequired) {
+		if err := reply4(conn, socks5.StatusNotAllowedByRuleSet, nil); err != nil {
+			return fmt.Errorf("failed to reply: %v", err)
+		}
+		return errMethodNotAllowed
+	}
+	switch req.Command {
+	case socks5.CmdConnect:
+	default:
+		if err := reply4(conn, socks5.StatusCommandNotSupported, nil); err != nil {
+			return fmt.Errorf("failed to reply: %v", err)
+		}
+		return ErrCommandNotSupported
+	}
+	return s.handle(ctx, conn, req, s.config.Handlers[req.Command])
+}
+
+// reply4 sends SOCKS4 reply. Any failure is sent as request rejected.
+//
+// +----+----+----+----+----+----+----+----+
+// | VN | CD | DSTPORT |      DSTIP        |
+// +----+----+----+----+----+----+----+----+
+// | 1  | 1  |    2    |         4         |
+// +----+----+----+----+----+----+----+----+
+func reply4(w io.Writer, reply socks5.Reply, addr *address.Info) error {
+	code := socks5.Socks4Rejected
+	if reply == socks5.StatusSucceeded {
+		code = socks5.Socks4Granted
+	}
+	msg := make([]byte, 8)
+	msg[1] = byte(code)
+	if addr != nil && addr.Type == address.TypeIPv4 {
+		msg[2], msg[3] = byte(addr.Port>>8), byte(addr.Port)
+		copy(msg[4:], addr.Host)
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// peekConn is a connection whose first bytes have been read to detect
+// the protocol. The bytes are read again.
+type peekConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func newPeekConn(conn net.Conn, peeked []byte) *peekConn {
+	return &peekConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader(peeked), conn),
+	}
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// NetConn returns the underlying connection.
+func (c *peekConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *peekConn) CloseWrite() error {
+	return connutil.CloseWrite(c.Conn, nil)
+}
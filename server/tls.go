@@ -0,0 +1,159 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/auth"
+)
+
+var errNoClientCertificate = errors.New("no verified client certificate")
+
+var _ auth.ConnAuthenticator = (*ClientCertificate)(nil)
+
+// ClientCertificate authenticates the client by the verified certificate
+// of TLS connection. Config.TLSConfig.ClientAuth must be set to verify
+// the certificates.
+//
+// If Next is nil, the certificate replaces the authentication method,
+// and ClientCertificate should be mapped to auth.MethodNotRequired.
+// Otherwise Next also authenticates the client after the certificate is
+// verified, e.g. UsernamePassword to require both of them. The identity
+// reported by Next is used if any. If Next is an auth.ConnAuthenticator
+// such as GSSAPI, the connection is encapsulated by Next.
+type ClientCertificate struct {
+	Next auth.Authenticator
+
+	// Username returns the name of the user from the certificate.
+	// The common name of the subject is used if nil, and then the first
+	// email address, DNS name or URI in the subject alternative names.
+	Username func(cert *x509.Certificate) (string, error)
+}
+
+func (c *ClientCertificate) Authenticate(conn io.ReadWriter) error {
+	_, err := c.AuthenticateIdentity(conn)
+	return err
+}
+
+// AuthenticateConn verifies the client certificate, and returns the
+// connection encapsulated by Next if any and the identity which has the
+// certificate.
+func (c *ClientCertificate) AuthenticateConn(conn net.Conn) (net.Conn, *auth.Identity, error) {
+	next, ok := c.Next.(auth.ConnAuthenticator)
+	if !ok {
+		id, err := c.AuthenticateIdentity(conn)
+		return conn, id, err
+	}
+	id, err := c.verify(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	nextConn, nextID, err := next.AuthenticateConn(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if nextID != nil {
+		nextID.Certificate = id.Certificate
+		return nextConn, nextID, nil
+	}
+	return nextConn, id, nil
+}
+
+// AuthenticateIdentity verifies the client certificate, and returns the
+// identity which has the certificate.
+func (c *ClientCertificate) AuthenticateIdentity(conn io.ReadWriter) (*auth.Identity, error) {
+	id, err := c.verify(conn)
+	if err != nil {
+		return nil, err
+	}
+	return c.next(conn, id)
+}
+
+// verify returns the identity of the verified client certificate, or
+// rejects the client.
+func (c *ClientCertificate) verify(conn io.ReadWriter) (*auth.Identity, error) {
+	cert, err := verifiedCertificate(conn)
+	if err == nil {
+		username := commonName
+		if c.Username != nil {
+			username = c.Username
+		}
+		id := &auth.Identity{
+			Method:      auth.MethodNotRequired,
+			Certificate: cert,
+		}
+		id.User, err = username(cert)
+		if err == nil {
+			return id, nil
+		}
+	}
+	conn.Write([]byte{
+		socks5.Version,
+		byte(auth.MethodNoAcceptableMethods),
+	})
+	return nil, fmt.Errorf("%w: %v", auth.ErrAuthenticationFailed, err)
+}
+
+func (c *ClientCertificate) next(conn io.ReadWriter, id *auth.Identity) (*auth.Identity, error) {
+	switch next := c.Next.(type) {
+	case nil:
+		_, err := conn.Write([]byte{
+			socks5.Version,
+			byte(auth.MethodNotRequired),
+		})
+		return id, err
+	case auth.IdentityAuthenticator:
+		nextID, err := next.AuthenticateIdentity(conn)
+		if err != nil {
+			return nil, err
+		}
+		if nextID != nil {
+			nextID.Certificate = id.Certificate
+			return nextID, nil
+		}
+		return id, nil
+	default:
+		if err := next.Authenticate(conn); err != nil {
+			return nil, err
+		}
+		return id, nil
+	}
+}
+
+// verifiedCertificate returns the leaf certificate of the client verified
+// by TLS. The wrappers of the connection are unwrapped by NetConn method.
+func verifiedCertificate(conn io.ReadWriter) (*x509.Certificate, error) {
+	for {
+		switch c := conn.(type) {
+		case interface{ ConnectionState() tls.ConnectionState }:
+			state := c.ConnectionState()
+			if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+				return nil, errNoClientCertificate
+			}
+			return state.PeerCertificates[0], nil
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, errNoClientCertificate
+		}
+	}
+}
+
+func commonName(cert *x509.Certificate) (string, error) {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName, nil
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0], nil
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0], nil
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String(), nil
+	}
+	return "", errors.New("no username in the client certificate")
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/auth"
+	"github.com/Code-Hex/socks5/internal/addrutil"
+	"github.com/Code-Hex/socks5/proxy"
+)
+
+// An Upstream represents an upstream SOCKS5 proxy.
+type Upstream struct {
+	Network string // "tcp" if empty
+	Address string
+
+	// Optional. Username/password authentication is used if Username
+	// is not empty.
+	Username string
+	Password string
+}
+
+func (u *Upstream) dialListener(cmd socks5.Command) (*proxy.DialListener, error) {
+	network := u.Network
+	if network == "" {
+		network = "tcp"
+	}
+	d, err := proxy.Socks5(context.Background(), cmd, network, u.Address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Username != "" {
+		d.AuthMethods = map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &proxy.UsernamePassword{
+				Username: u.Username,
+				Password: u.Password,
+			},
+		}
+	}
+	return d, nil
+}
+
+// A Chain is a dialer which forwards connections through the upstream
+// proxies in order. TCP connections are forwarded by CONNECT command,
+// UDP by UDP ASSOCIATE command of the last upstream.
+// The reply code from the upstreams is carried back to the client as is.
+type Chain struct {
+	Upstreams []Upstream
+
+	// ProxyDial is used to connect to the first upstream. Optional.
+	ProxyDial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialContext connects to the address on the named network through
+// the upstreams.
+func (c *Chain) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(c.Upstreams) == 0 {
+		return nil, errors.New("no upstreams in the chain")
+	}
+
+	dial := c.ProxyDial
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	last := len(c.Upstreams) - 1
+	for i := range c.Upstreams[:last] {
+		d, err := c.Upstreams[i].dialListener(socks5.CmdConnect)
+		if err != nil {
+			return nil, err
+		}
+		d.ProxyDial = dial
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := d.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+
+	cmd := socks5.CmdConnect
+	switch network {
+	case "udp", "udp4", "udp6":
+		cmd = socks5.CmdUDPAssociate
+	}
+	d, err := c.Upstreams[last].dialListener(cmd)
+	if err != nil {
+		return nil, err
+	}
+	d.ProxyDial = dial
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// A Route selects upstreams for the destinations which match.
+type Route struct {
+	// Match is the pattern of destination host, matched as in RewriteRule.
+	Match string
+
+	// Port restricts the route to the destination port. Zero matches any port.
+	Port int
+
+	// Upstreams are the chain of upstream proxies. The destinations are
+	// connected directly if it is empty.
+	Upstreams []Upstream
+}
+
+type route struct {
+	*matcher
+	upstreams []Upstream
+}
+
+// A RouteTable selects upstreams per destination. The first route which
+// matches is used.
+//
+// It is safe for concurrent use, the routes can be replaced at runtime
+// by Reload.
+type RouteTable struct {
+	mu     sync.RWMutex
+	routes []*route
+}
+
+// NewRouteTable returns a new table which has routes.
+func NewRouteTable(routes []Route) (*RouteTable, error) {
+	t := new(RouteTable)
+	if err := t.Reload(routes); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload replaces all routes as RewriteTable.Reload.
+func (t *RouteTable) Reload(routes []Route) error {
+	parsed := make([]*route, 0, len(routes))
+	for _, r := range routes {
+		m, err := newMatcher(r.Match, r.Port)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, &route{
+			matcher:   m,
+			upstreams: r.Upstreams,
+		})
+	}
+	t.mu.Lock()
+	t.routes = parsed
+	t.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the upstreams for the address such as "example.com:443".
+// ok is false if no routes match.
+func (t *RouteTable) Lookup(address string) (upstreams []Upstream, ok bool) {
+	host, port, err := addrutil.SplitHostPort(address)
+	if err != nil {
+		return nil, false
+	}
+	info, err := addrInfoFromHostPort(host, port)
+	if err != nil {
+		return nil, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, r := range t.routes {
+		if r.match(info) {
+			return r.upstreams, true
+		}
+	}
+	return nil, false
+}
+
+// upstreamDialer forwards connections by Config.Upstreams and Config.Routes.
+type upstreamDialer struct {
+	dialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	upstreams   []Upstream
+	routes      *RouteTable
+}
+
+func (u *upstreamDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	upstreams := u.upstreams
+	if u.routes != nil {
+		if routed, ok := u.routes.Lookup(address); ok {
+			upstreams = routed
+		}
+	}
+	if len(upstreams) == 0 {
+		return u.dialContext(ctx, network, address)
+	}
+	chain := &Chain{
+		Upstreams: upstreams,
+		ProxyDial: u.dialContext,
+	}
+	return chain.DialContext(ctx, network, address)
+}
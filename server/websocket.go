@@ -0,0 +1,90 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketHandler returns a handler which serves SOCKS over WebSocket.
+// The byte stream of SOCKS is carried by binary messages. After UDP
+// ASSOCIATE is replied, each message carries a UDP request header and
+// the datagram instead of relaying them over UDP.
+func (s *Socks5) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			ctx := ws.Request().Context()
+			local, _ := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+			conn := &wsConn{Conn: ws, remote: httpRemoteAddr(ws.Request())}
+			udpConn := &wsPacketConn{Conn: ws, local: local, remote: conn.remote}
+			if err := s.serveConn(ctx, conn, udpConn); err != nil {
+				log.Printf("socks5: error(websocket) %v", err)
+			}
+		},
+	}
+}
+
+// wsConn is the WebSocket connection whose remote address is the peer of
+// the HTTP connection. websocket.Conn returns the Origin header of the
+// client instead, which must not be used for the limits and the rules.
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// httpRemoteAddr parses the remote address of the HTTP request. It returns
+// the zero TCPAddr if the address is not an IP address and port.
+func httpRemoteAddr(req *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// wsPacketConn carries datagrams by the messages of WebSocket.
+type wsPacketConn struct {
+	*websocket.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+var _ net.PacketConn = (*wsPacketConn)(nil)
+
+func (c *wsPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var msg []byte
+	if err := websocket.Message.Receive(c.Conn, &msg); err != nil {
+		return 0, nil, err
+	}
+	return copy(b, msg), c.remote, nil
+}
+
+func (c *wsPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	if err := websocket.Message.Send(c.Conn, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// LocalAddr returns the local address of the HTTP connection, which is
+// replied as the relay address since the datagrams are relayed on it.
+func (c *wsPacketConn) LocalAddr() net.Addr {
+	if c.local == nil {
+		return &net.TCPAddr{IP: net.IPv4zero}
+	}
+	return c.local
+}
+
+// Close does nothing, the WebSocket connection is closed by serveConn.
+func (c *wsPacketConn) Close() error {
+	return nil
+}
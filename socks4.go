@@ -0,0 +1,50 @@
+package socks5
+
+import "fmt"
+
+// Socks4Version is the version of SOCKS4 and SOCKS4a.
+// See: https://www.openssh.com/txt/socks4.protocol
+const Socks4Version = 4
+
+// A Socks4Reply represents a SOCKS4 reply code.
+type Socks4Reply byte
+
+const (
+	// Socks4Granted represents request granted.
+	Socks4Granted Socks4Reply = 0x5a
+
+	// Socks4Rejected represents request rejected or failed.
+	Socks4Rejected Socks4Reply = 0x5b
+
+	// Socks4IdentdUnreachable represents request rejected because
+	// SOCKS server cannot connect to identd on the client.
+	Socks4IdentdUnreachable Socks4Reply = 0x5c
+
+	// Socks4IdentdMismatch represents request rejected because the client
+	// program and identd report different user-ids.
+	Socks4IdentdMismatch Socks4Reply = 0x5d
+)
+
+func (code Socks4Reply) String() string {
+	switch code {
+	case Socks4Granted:
+		return "request granted"
+	case Socks4Rejected:
+		return "request rejected or failed"
+	case Socks4IdentdUnreachable:
+		return "request rejected because identd is unreachable"
+	case Socks4IdentdMismatch:
+		return "request rejected because user-ids mismatch"
+	default:
+		return fmt.Sprintf("unknown code: %d", code)
+	}
+}
+
+// A Socks4ReplyError represents a SOCKS4 request which is not granted.
+type Socks4ReplyError struct {
+	Reply Socks4Reply
+}
+
+func (e *Socks4ReplyError) Error() string {
+	return e.Reply.String()
+}
@@ -3,14 +3,44 @@ package socks5_test
 import (
 	"bufio"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/address"
+	"github.com/Code-Hex/socks5/auth"
 	"github.com/Code-Hex/socks5/proxy"
+	"github.com/Code-Hex/socks5/proxy/sshtunnel"
 	"github.com/Code-Hex/socks5/server"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var addressCase = []string{
@@ -92,84 +122,2772 @@ func TestSocks5_Connect(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("bind address", func(t *testing.T) {
+		socks5Addr := socks5Server(t, "127.0.0.1:0").Addr()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		// the remote address of the accepted connection is the local
+		// address of the connection made by the server.
+		targets := make(chan net.Addr, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				targets <- nil
+				return
+			}
+			defer conn.Close()
+			targets <- conn.RemoteAddr()
+			io.Copy(ioutil.Discard, conn)
+		}()
+
+		conn, err := net.Dial("tcp", socks5Addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		port := ln.Addr().(*net.TCPAddr).Port
+		req := []byte{socks5.Version, 1, byte(auth.MethodNotRequired)}
+		req = append(req, socks5.Version, byte(socks5.CmdConnect), 0, byte(address.TypeIPv4), 127, 0, 0, 1, byte(port>>8), byte(port))
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		// method selection and the reply which has BND.ADDR and BND.PORT.
+		resp := make([]byte, 2+10)
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		if socks5.Reply(resp[3]) != socks5.StatusSucceeded || address.Type(resp[5]) != address.TypeIPv4 {
+			t.Fatalf("unexpected response: %v", resp)
+		}
+		got := &net.TCPAddr{IP: net.IP(resp[6:10]), Port: int(resp[10])<<8 | int(resp[11])}
+		if want := <-targets; want.String() != got.String() {
+			t.Fatalf("want %v, but got %v", want, got)
+		}
+	})
+}
+
+func TestSocks5_Bind(t *testing.T) {
+	for _, address := range addressCase {
+		t.Run(address, func(t *testing.T) {
+			socks5Ln := socks5Server(t, address)
+			ctx := context.Background()
+			socks5Addr := socks5Ln.Addr()
+
+			dialer, err := proxy.Socks5(ctx, socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			echoLn, waitCh := echoBindServer(t, address)
+			echoAddr := echoLn.Addr()
+			conn1, err := dialer.Dial(echoAddr.Network(), echoAddr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn1.Close()
+
+			dialer2, err := proxy.Socks5(ctx, socks5.CmdBind, socks5Addr.Network(), socks5Addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ln, err := dialer2.Listen("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := ln.Addr()
+			_, err = conn1.Write([]byte(addr.String() + "\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// wait to dial tcp from echo bind server
+			<-waitCh
+
+			want := "OK"
+			_, err = conn1.Write([]byte(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn2, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn2.Close()
+
+			buf := make([]byte, 2)
+			if _, err := conn2.Read(buf); err != nil {
+				t.Fatal(err)
+			}
+			got := string(buf)
+			if want != got {
+				t.Fatalf("want %s, but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestSocks5_ConnectIPPolicy(t *testing.T) {
+	cases := []struct {
+		policy  server.IPPolicy
+		wantErr bool
+	}{
+		{policy: server.PreferIPv6},
+		{policy: server.PreferIPv4},
+		{policy: server.IPv4Only},
+		{policy: server.IPv6Only, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+				IPPolicy: tc.policy,
+			})
+			echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+			socks5Addr := socks5Ln.Addr()
+			ctx := context.Background()
+			p, err := proxy.Socks5(ctx, socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// echo server listens on 127.0.0.1 only.
+			_, port, _ := net.SplitHostPort(echoLn.Addr().String())
+			conn, err := p.Dial("tcp", net.JoinHostPort("localhost", port))
+			if tc.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("want error, but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			want := "OK"
+			if _, err := conn.Write([]byte(want)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 2)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf); want != got {
+				t.Fatalf(`want %s, but got %s`, want, got)
+			}
+		})
+	}
+}
+
+func TestSocks5_Resolve(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0")
+	socks5Addr := socks5Ln.Addr()
+	ctx := context.Background()
+
+	// command is not used by lookups.
+	p, err := proxy.Socks5(ctx, socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("resolve", func(t *testing.T) {
+		addrs, err := p.LookupHost(ctx, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || !net.ParseIP(addrs[0]).IsLoopback() {
+			t.Fatalf("want loopback address, but got %v", addrs)
+		}
+	})
+
+	t.Run("resolve ptr", func(t *testing.T) {
+		names, err := p.LookupAddr(ctx, "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 1 || names[0] == "" {
+			t.Fatalf("want a name, but got %v", names)
+		}
+	})
+
+	t.Run("unknown host", func(t *testing.T) {
+		_, err := p.LookupHost(ctx, "unknown.invalid")
+		if err == nil {
+			t.Fatal("want error, but got nil")
+		}
+		if _, ok := err.(*net.DNSError); !ok {
+			t.Fatalf("want *net.DNSError, but got %T", err)
+		}
+	})
+}
+
+func TestSocks5_Handlers(t *testing.T) {
+	const cmdPing socks5.Command = 0x80
+
+	var connected int32
+	handlers := server.DefaultHandlers()
+	connect := handlers[socks5.CmdConnect]
+	handlers[socks5.CmdConnect] = server.HandlerFunc(func(ctx context.Context, w server.ResponseWriter, r *server.Request) error {
+		atomic.AddInt32(&connected, 1)
+		return connect.ServeSOCKS(ctx, w, r)
+	})
+	handlers[socks5.CmdBind] = nil
+	handlers[cmdPing] = server.HandlerFunc(func(ctx context.Context, w server.ResponseWriter, r *server.Request) error {
+		if err := w.Reply(socks5.StatusSucceeded, nil); err != nil {
+			return err
+		}
+		_, err := w.Write([]byte("pong"))
+		return err
+	})
+
+	socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		Handlers: handlers,
+	})
+	socks5Addr := socks5Ln.Addr()
+
+	t.Run("wrapped", func(t *testing.T) {
+		echoLn := echoConnectServer(t, "127.0.0.1:0")
+		p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoAddr := echoLn.Addr()
+		conn, err := p.Dial(echoAddr.Network(), echoAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if got := atomic.LoadInt32(&connected); got != 1 {
+			t.Fatalf("want 1 call, but got %d", got)
+		}
+	})
+
+	cases := []struct {
+		name     string
+		cmd      socks5.Command
+		want     socks5.Reply
+		wantBody string
+	}{
+		{name: "custom", cmd: cmdPing, want: socks5.StatusSucceeded, wantBody: "pong"},
+		{name: "disabled", cmd: socks5.CmdBind, want: socks5.StatusCommandNotSupported},
+		{name: "unknown", cmd: 0x81, want: socks5.StatusCommandNotSupported},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial(socks5Addr.Network(), socks5Addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write([]byte{socks5.Version, 1, 0}); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 10)
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				t.Fatal(err)
+			}
+			req := []byte{socks5.Version, byte(tc.cmd), 0, 1, 127, 0, 0, 1, 0, 80}
+			if _, err := conn.Write(req); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := socks5.Reply(buf[1]); tc.want != got {
+				t.Fatalf("want %v, but got %v", tc.want, got)
+			}
+			if tc.wantBody == "" {
+				return
+			}
+			body := make([]byte, len(tc.wantBody))
+			if _, err := io.ReadFull(conn, body); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(body); tc.wantBody != got {
+				t.Fatalf("want %s, but got %s", tc.wantBody, got)
+			}
+		})
+	}
+}
+
+func TestSocks5_Middlewares(t *testing.T) {
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+	echoAddr := echoLn.Addr().(*net.TCPAddr)
+
+	type result struct {
+		status           socks5.Reply
+		upload, download int64
+	}
+	results := make(chan result, 1)
+
+	observe := func(next server.Handler) server.Handler {
+		return server.HandlerFunc(func(ctx context.Context, w server.ResponseWriter, r *server.Request) error {
+			err := next.ServeSOCKS(ctx, w, r)
+			status, _ := w.Status()
+			upload, download := r.Traffic()
+			results <- result{status, upload, download}
+			return err
+		})
+	}
+	deny := func(next server.Handler) server.Handler {
+		return server.HandlerFunc(func(ctx context.Context, w server.ResponseWriter, r *server.Request) error {
+			if r.DestAddr.Port == 25 {
+				return &socks5.ReplyError{Reply: socks5.StatusNotAllowedByRuleSet}
+			}
+			return next.ServeSOCKS(ctx, w, r)
+		})
+	}
+	rewrite := func(next server.Handler) server.Handler {
+		return server.HandlerFunc(func(ctx context.Context, w server.ResponseWriter, r *server.Request) error {
+			r.DestAddr = &address.Info{
+				Host: address.Host(echoAddr.IP.To4()),
+				Port: echoAddr.Port,
+				Type: address.TypeIPv4,
+			}
+			return next.ServeSOCKS(ctx, w, r)
+		})
+	}
+
+	socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		Middlewares: []server.Middleware{observe, deny, rewrite},
+	})
+	socks5Addr := socks5Ln.Addr()
+	p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("short circuit", func(t *testing.T) {
+		_, err := p.Dial("tcp", "192.0.2.1:25")
+		if err == nil {
+			t.Fatal("want error, but got nil")
+		}
+		got := <-results
+		if want := socks5.StatusNotAllowedByRuleSet; want != got.status {
+			t.Fatalf("want %v, but got %v", want, got.status)
+		}
+	})
+
+	t.Run("rewrite", func(t *testing.T) {
+		conn, err := p.Dial("tcp", "192.0.2.1:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "OK"
+		if _, err := conn.Write([]byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf); want != got {
+			t.Fatalf("want %s, but got %s", want, got)
+		}
+		conn.Close()
+
+		got := <-results
+		if got.status != socks5.StatusSucceeded || got.upload != 2 || got.download != 2 {
+			t.Fatalf("unexpected result: %+v", got)
+		}
+	})
+}
+
+func TestSocks5_Rewrites(t *testing.T) {
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+	echoAddr := echoLn.Addr().String()
+
+	rewrites, err := server.NewRewriteTable([]server.RewriteRule{
+		{Match: "api.internal", Port: 443, To: echoAddr},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := make(chan string, 1)
+	socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		Rewrites: rewrites,
+		Middlewares: []server.Middleware{
+			func(next server.Handler) server.Handler {
+				return server.HandlerFunc(func(ctx context.Context, w server.ResponseWriter, r *server.Request) error {
+					original <- r.OriginalAddr.String()
+					return next.ServeSOCKS(ctx, w, r)
+				})
+			},
+		},
+	})
+	socks5Addr := socks5Ln.Addr()
+	p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := p.Dial("tcp", "api.internal:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if want, got := "api.internal:443", <-original; want != got {
+		t.Fatalf("want %s, but got %s", want, got)
+	}
+
+	if err := rewrites.Reload(nil); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := p.Dial("tcp", "api.internal:443"); err == nil {
+		conn.Close()
+		t.Fatal("want error after reload, but got nil")
+	}
+	<-original
+}
+
+func TestSocks5_Upstreams(t *testing.T) {
+	credentials := auth.CredentialStoreFunc(func(username, password string) bool {
+		return username == "user" && password == "pass"
+	})
+	lastLn := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &server.UsernamePassword{
+				Credentials: credentials,
+			},
+		},
+		Middlewares: []server.Middleware{
+			func(next server.Handler) server.Handler {
+				return server.HandlerFunc(func(ctx context.Context, w server.ResponseWriter, r *server.Request) error {
+					if r.DestAddr.Port == 25 {
+						return &socks5.ReplyError{Reply: socks5.StatusNotAllowedByRuleSet}
+					}
+					return next.ServeSOCKS(ctx, w, r)
+				})
+			},
+		},
+	})
+	firstLn := socks5Server(t, "127.0.0.1:0")
+
+	cases := []struct {
+		name      string
+		upstreams []server.Upstream
+		address   func() string
+		wantErr   socks5.Reply
+	}{
+		{
+			name: "single",
+			upstreams: []server.Upstream{
+				{Address: lastLn.Addr().String(), Username: "user", Password: "pass"},
+			},
+		},
+		{
+			name: "multi hop",
+			upstreams: []server.Upstream{
+				{Address: firstLn.Addr().String()},
+				{Address: lastLn.Addr().String(), Username: "user", Password: "pass"},
+			},
+		},
+		{
+			name: "reply code",
+			upstreams: []server.Upstream{
+				{Address: firstLn.Addr().String()},
+				{Address: lastLn.Addr().String(), Username: "user", Password: "pass"},
+			},
+			address: func() string { return "127.0.0.1:25" },
+			wantErr: socks5.StatusNotAllowedByRuleSet,
+		},
+		{
+			name: "wrong password",
+			upstreams: []server.Upstream{
+				{Address: lastLn.Addr().String(), Username: "user", Password: "wrong"},
+			},
+			wantErr: socks5.StatusGeneralServerFailure,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+				Upstreams: tc.upstreams,
+			})
+			socks5Addr := socks5Ln.Addr()
+			p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			address := tc.address
+			if address == nil {
+				address = func() string {
+					return echoConnectServer(t, "127.0.0.1:0").Addr().String()
+				}
+			}
+			conn, err := p.Dial("tcp", address())
+			if tc.wantErr != socks5.StatusSucceeded {
+				var replyErr *socks5.ReplyError
+				if !errors.As(err, &replyErr) {
+					t.Fatalf("want *socks5.ReplyError, but got %v", err)
+				}
+				if tc.wantErr != replyErr.Reply {
+					t.Fatalf("want %v, but got %v", tc.wantErr, replyErr.Reply)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			want := "OK"
+			if _, err := conn.Write([]byte(want)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 2)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf); want != got {
+				t.Fatalf("want %s, but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestSocks5_UpstreamsUDPAssociate(t *testing.T) {
+	lastLn := socks5Server(t, "127.0.0.1:0")
+	socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		Upstreams: []server.Upstream{
+			{Address: lastLn.Addr().String()},
+		},
+	})
+	socks5Addr := socks5Ln.Addr()
+
+	addr := echoUdpServer(t, "127.0.0.1:0")
+	dialer, err := proxy.Socks5(context.Background(), socks5.CmdUDPAssociate, socks5Addr.Network(), socks5Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := "OK"
+	if _, err := conn.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); want != got {
+		t.Fatalf("want %s, but got %s", want, got)
+	}
+}
+
+func TestSocks5_Pool(t *testing.T) {
+	upstreamLn := socks5Server(t, "127.0.0.1:0")
+
+	// reserve an address which refuses connections.
+	deadLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLn.Close()
+
+	for _, balance := range []server.Balance{
+		server.RoundRobin,
+		server.LeastConnections,
+		server.HashDestination,
+		server.HashUser,
+	} {
+		t.Run(balance.String(), func(t *testing.T) {
+			pool := server.NewPool(&server.PoolConfig{
+				Upstreams: []server.Upstream{
+					{Address: deadLn.Addr().String()},
+					{Address: upstreamLn.Addr().String()},
+				},
+				Balance: balance,
+			})
+			defer pool.Close()
+
+			socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+				DialContext: pool.DialContext,
+			})
+			socks5Addr := socks5Ln.Addr()
+			p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
+				conn, err := p.Dial(echoAddr.Network(), echoAddr.String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+			}
+
+			// hash balancing may not select the dead upstream.
+			if balance == server.HashDestination || balance == server.HashUser {
+				return
+			}
+			for _, status := range pool.Status() {
+				want := status.Upstream.Address != deadLn.Addr().String()
+				if want != status.Up {
+					t.Errorf("%s: want up %v, but got %v", status.Upstream.Address, want, status.Up)
+				}
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		balance server.Balance
+		ctx     context.Context
+	}{
+		{
+			// the same destination host on the different ports.
+			balance: server.HashDestination,
+			ctx:     context.Background(),
+		},
+		{
+			// the same user to the different destinations.
+			balance: server.HashUser,
+			ctx:     auth.NewContext(context.Background(), &auth.Identity{User: "alice"}),
+		},
+	} {
+		t.Run(tc.balance.String()+" sticky", func(t *testing.T) {
+			var upstreams []server.Upstream
+			for i := 0; i < 3; i++ {
+				upstreams = append(upstreams, server.Upstream{
+					Address: socks5Server(t, "127.0.0.1:0").Addr().String(),
+				})
+			}
+			pool := server.NewPool(&server.PoolConfig{
+				Upstreams: upstreams,
+				Balance:   tc.balance,
+			})
+			defer pool.Close()
+
+			const n = 5
+			for i := 0; i < n; i++ {
+				echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
+				conn, err := pool.DialContext(tc.ctx, echoAddr.Network(), echoAddr.String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+			}
+			var used int
+			for _, status := range pool.Status() {
+				switch status.Active {
+				case 0:
+				case n:
+					used++
+				default:
+					t.Fatalf("%s: want 0 or %d active connections, but got %d", status.Upstream.Address, n, status.Active)
+				}
+			}
+			if used != 1 {
+				t.Fatalf("want 1 upstream used, but got %d", used)
+			}
+		})
+	}
+
+	t.Run("health check", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		downAddr := ln.Addr().String()
+		ln.Close()
+
+		pool := server.NewPool(&server.PoolConfig{
+			Upstreams: []server.Upstream{
+				{Address: downAddr},
+				{Address: upstreamLn.Addr().String()},
+			},
+			HealthCheckInterval: 10 * time.Millisecond,
+		})
+		defer pool.Close()
+
+		echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
+		conn, err := pool.DialContext(context.Background(), echoAddr.Network(), echoAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if status := pool.Status()[0]; status.Up {
+			t.Fatalf("want %s down", downAddr)
+		}
+
+		// the upstream comes back on the same address.
+		socks5Server(t, downAddr)
+		deadline := time.Now().Add(5 * time.Second)
+		for !pool.Status()[0].Up {
+			if time.Now().After(deadline) {
+				t.Fatalf("want %s up again", downAddr)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestSocks5_HTTPConnectUpstream(t *testing.T) {
+	httpProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" { // user:pass
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	}))
+	defer httpProxy.Close()
+	httpProxyAddr := httpProxy.Listener.Addr().String()
+
+	// reserve an address which refuses connections.
+	deadLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLn.Close()
+
+	cases := []struct {
+		name     string
+		username string
+		address  func() string
+		want     socks5.Reply
+	}{
+		{
+			name:     "succeeded",
+			username: "user",
+			address: func() string {
+				return echoConnectServer(t, "127.0.0.1:0").Addr().String()
+			},
+			want: socks5.StatusSucceeded,
+		},
+		{
+			name:     "bad gateway",
+			username: "user",
+			address:  func() string { return deadLn.Addr().String() },
+			want:     socks5.StatusHostUnreachable,
+		},
+		{
+			name:     "proxy auth required",
+			username: "unknown",
+			address:  func() string { return deadLn.Addr().String() },
+			want:     socks5.StatusNotAllowedByRuleSet,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := &proxy.HTTPConnect{
+				Address:  httpProxyAddr,
+				Username: tc.username,
+				Password: "pass",
+			}
+			socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+				DialContext: upstream.DialContext,
+			})
+			socks5Addr := socks5Ln.Addr()
+			p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := p.Dial("tcp", tc.address())
+			if tc.want != socks5.StatusSucceeded {
+				var replyErr *socks5.ReplyError
+				if !errors.As(err, &replyErr) {
+					t.Fatalf("want *socks5.ReplyError, but got %v", err)
+				}
+				if tc.want != replyErr.Reply {
+					t.Fatalf("want %v, but got %v", tc.want, replyErr.Reply)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			want := "OK"
+			if _, err := conn.Write([]byte(want)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 2)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf); want != got {
+				t.Fatalf("want %s, but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestSocks5_SSHTunnelUpstream(t *testing.T) {
+	sshAddr, hostKey, disconnect := sshServer(t)
+
+	dir, err := ioutil.TempDir("", "sshtunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(sshAddr)}, hostKey)
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel, err := sshtunnel.New(&sshtunnel.Config{
+		Address:         sshAddr,
+		User:            "user",
+		Password:        "pass",
+		KnownHostsFiles: []string{knownHosts},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		DialContext: tunnel.DialContext,
+	})
+	socks5Addr := socks5Ln.Addr()
+	p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second dial reconnects to the SSH server.
+	for i := 0; i < 2; i++ {
+		echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
+		conn, err := p.Dial(echoAddr.Network(), echoAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "OK"
+		if _, err := conn.Write([]byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf); want != got {
+			t.Fatalf("want %s, but got %s", want, got)
+		}
+		conn.Close()
+		disconnect()
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		// a server which accepts but never completes the SSH handshake.
+		silentLn, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer silentLn.Close()
+		go func() {
+			for {
+				conn, err := silentLn.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+		tunnel, err := sshtunnel.New(&sshtunnel.Config{
+			Address:         silentLn.Addr().String(),
+			User:            "user",
+			Password:        "pass",
+			HostKeyCallback: ssh.FixedHostKey(hostKey),
+			Timeout:         100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tunnel.Close()
+
+		start := time.Now()
+		if _, err := tunnel.DialContext(context.Background(), "tcp", "127.0.0.1:80"); err == nil {
+			t.Fatal("want error, but got nil")
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("want timeout, but took %v", elapsed)
+		}
+	})
+}
+
+func TestSocks5_Socks4(t *testing.T) {
+	userIDs := make(chan string, 1)
+	socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		EnableSOCKS4:  true,
+		DisableSOCKS5: true,
+		Middlewares: []server.Middleware{
+			func(next server.Handler) server.Handler {
+				return server.HandlerFunc(func(ctx context.Context, w server.ResponseWriter, r *server.Request) error {
+					userIDs <- r.UserID
+					return next.ServeSOCKS(ctx, w, r)
+				})
+			},
+		},
+	})
+	socks5Addr := socks5Ln.Addr().String()
+
+	cases := []struct {
+		name string
+		host []byte // DSTIP and the trailing hostname of SOCKS4a
+	}{
+		{
+			name: "socks4",
+			host: []byte{127, 0, 0, 1},
+		},
+		{
+			name: "socks4a",
+			host: []byte{0, 0, 0, 1},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr().(*net.TCPAddr)
+			conn, err := net.Dial("tcp", socks5Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			req := []byte{socks5.Socks4Version, byte(socks5.CmdConnect), byte(echoAddr.Port >> 8), byte(echoAddr.Port)}
+			req = append(req, tc.host...)
+			req = append(req, "u\x00"...)
+			if tc.host[0] == 0 {
+				req = append(req, "127.0.0.1\x00"...)
+			}
+			if _, err := conn.Write(req); err != nil {
+				t.Fatal(err)
+			}
+			resp := make([]byte, 8)
+			if _, err := io.ReadFull(conn, resp); err != nil {
+				t.Fatal(err)
+			}
+			if want, got := socks5.Socks4Granted, socks5.Socks4Reply(resp[1]); want != got {
+				t.Fatalf("want %v, but got %v", want, got)
+			}
+			if want, got := "u", <-userIDs; want != got {
+				t.Fatalf("want user id %q, but got %q", want, got)
+			}
+
+			want := "hello"
+			if _, err := conn.Write([]byte(want)); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if want != string(got) {
+				t.Fatalf("want %q, but got %q", want, got)
+			}
+		})
+	}
+
+	t.Run("auth required", func(t *testing.T) {
+		authLn := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+			EnableSOCKS4: true,
+			AuthMethods: map[auth.Method]auth.Authenticator{
+				auth.MethodUsernamePassword: &server.UsernamePassword{
+					Credentials: auth.CredentialStoreFunc(func(username, password string) bool {
+						return false
+					}),
+				},
+			},
+		})
+		echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr().(*net.TCPAddr)
+		conn, err := net.Dial("tcp", authLn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		req := []byte{socks5.Socks4Version, byte(socks5.CmdConnect), byte(echoAddr.Port >> 8), byte(echoAddr.Port), 127, 0, 0, 1}
+		req = append(req, "u\x00"...)
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, 8)
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		if want, got := socks5.Socks4Rejected, socks5.Socks4Reply(resp[1]); want != got {
+			t.Fatalf("want %v, but got %v", want, got)
+		}
+	})
+
+	t.Run("bind", func(t *testing.T) {
+		echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr().(*net.TCPAddr)
+		conn, err := net.Dial("tcp", socks5Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		req := []byte{socks5.Socks4Version, byte(socks5.CmdBind), byte(echoAddr.Port >> 8), byte(echoAddr.Port), 127, 0, 0, 1}
+		req = append(req, "u\x00"...)
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, 8)
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		if want, got := socks5.Socks4Rejected, socks5.Socks4Reply(resp[1]); want != got {
+			t.Fatalf("want %v, but got %v", want, got)
+		}
+		// the server closes the connection instead of waiting for the peer.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(resp); err != io.EOF {
+			t.Fatalf("want %v, but got %v", io.EOF, err)
+		}
+	})
+
+	t.Run("client", func(t *testing.T) {
+		if _, err := proxy.Socks4(context.Background(), socks5.CmdBind, "tcp", socks5Addr); err == nil {
+			t.Fatal("want error for unsupported bind")
+		}
+		echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr().(*net.TCPAddr)
+		p, err := proxy.Socks4(context.Background(), socks5.CmdConnect, "tcp", socks5Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.UserID = "u"
+
+		conn, err := p.Dial("tcp", fmt.Sprintf("localhost:%d", echoAddr.Port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if want, got := "u", <-userIDs; want != got {
+			t.Fatalf("want user id %q, but got %q", want, got)
+		}
+		want := "hello"
+		if _, err := conn.Write([]byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if want != string(got) {
+			t.Fatalf("want %q, but got %q", want, got)
+		}
+
+		// nothing listens on the closed port.
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln.Close()
+		_, err = p.Dial("tcp", ln.Addr().String())
+		<-userIDs
+		var replyErr *socks5.Socks4ReplyError
+		if !errors.As(err, &replyErr) {
+			t.Fatalf("want *socks5.Socks4ReplyError, but got %v", err)
+		}
+		if replyErr.Reply != socks5.Socks4Rejected {
+			t.Fatalf("want %v, but got %v", socks5.Socks4Rejected, replyErr.Reply)
+		}
+	})
+
+	t.Run("socks5 disabled", func(t *testing.T) {
+		p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, "tcp", socks5Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := p.Dial("tcp", "127.0.0.1:80"); err == nil {
+			conn.Close()
+			t.Fatal("want error, but got nil")
+		}
+	})
+}
+
+func TestSocks5_HTTPProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer origin.Close()
+	tlsOrigin := httptest.NewTLSServer(origin.Config.Handler)
+	defer tlsOrigin.Close()
+
+	socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		EnableHTTP: true,
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &server.UsernamePassword{
+				Credentials: auth.CredentialStoreFunc(func(username, password string) bool {
+					return username == "user" && password == "pass"
+				}),
+			},
+		},
+	})
+	socks5Addr := socks5Ln.Addr().String()
+
+	get := func(userinfo *url.Userinfo, target string) (*http.Response, error) {
+		transport := tlsOrigin.Client().Transport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(&url.URL{
+			Scheme: "http",
+			Host:   socks5Addr,
+			User:   userinfo,
+		})
+		return (&http.Client{Transport: transport}).Get(target)
+	}
+
+	for name, target := range map[string]string{
+		"get":     origin.URL,
+		"connect": tlsOrigin.URL,
+	} {
+		target := target
+		t.Run(name, func(t *testing.T) {
+			resp, err := get(url.UserPassword("user", "pass"), target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := "hello", string(body); want != got {
+				t.Fatalf("want %q, but got %q", want, got)
+			}
+		})
+	}
+
+	t.Run("unauthorized", func(t *testing.T) {
+		resp, err := get(url.UserPassword("user", "wrong"), origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want, got := http.StatusProxyAuthRequired, resp.StatusCode; want != got {
+			t.Fatalf("want %d, but got %d", want, got)
+		}
+	})
+
+	t.Run("socks5", func(t *testing.T) {
+		echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
+		p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, "tcp", socks5Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.AuthMethods = map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &proxy.UsernamePassword{
+				Username: "user",
+				Password: "pass",
+			},
+		}
+		conn, err := p.Dial("tcp", echoAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+}
+
+func TestSocks5_TLS(t *testing.T) {
+	serverCert, clientCert, pool := certificates(t)
+
+	users := make(chan string, 1)
+	bans := make(chan server.Ban, 1)
+	socks5Ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(&server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodNotRequired: &server.ClientCertificate{},
+		},
+		AuthGuard: server.NewAuthGuard(&server.AuthGuardConfig{
+			MaxFailures: 1,
+			BaseDelay:   time.Millisecond,
+			OnBan: func(ban server.Ban) {
+				bans <- ban
+			},
+		}),
+		Middlewares: []server.Middleware{
+			func(next server.Handler) server.Handler {
+				return server.HandlerFunc(func(ctx context.Context, w server.ResponseWriter, r *server.Request) error {
+					users <- r.Identity.User
+					return next.ServeSOCKS(ctx, w, r)
+				})
+			},
+		},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    pool,
+		},
+	})
+	go s.ServeTLS(socks5Ln, "", "")
+	socks5Addr := socks5Ln.Addr()
+
+	dial := func(certs []tls.Certificate) (net.Conn, error) {
+		p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.TLSConfig = &tls.Config{
+			RootCAs:      pool,
+			Certificates: certs,
+		}
+		echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
+		return p.Dial("tcp", echoAddr.String())
+	}
+
+	t.Run("client certificate", func(t *testing.T) {
+		conn, err := dial([]tls.Certificate{clientCert})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if want, got := "alice", <-users; want != got {
+			t.Fatalf("want user %q, but got %q", want, got)
+		}
+		want := "hello"
+		if _, err := conn.Write([]byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if want != string(got) {
+			t.Fatalf("want %q, but got %q", want, got)
+		}
+	})
+
+	t.Run("no certificate", func(t *testing.T) {
+		if conn, err := dial(nil); err == nil {
+			conn.Close()
+			t.Fatal("want error, but got nil")
+		}
+		// the failure is counted by AuthGuard.
+		select {
+		case <-bans:
+		case <-time.After(5 * time.Second):
+			t.Fatal("want the client to be banned")
+		}
+	})
+}
+
+func TestSocks5_WebSocket(t *testing.T) {
+	ts := httptest.NewServer(server.New(nil).WebSocketHandler())
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+	ctx := context.Background()
+
+	t.Run("connect", func(t *testing.T) {
+		echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
+		p, err := proxy.Socks5(ctx, socks5.CmdConnect, "tcp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.WebSocketURL = wsURL
+		conn, err := p.Dial("tcp", echoAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		want := "hello"
+		if _, err := conn.Write([]byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if want != string(got) {
+			t.Fatalf("want %q, but got %q", want, got)
+		}
+	})
+
+	t.Run("udp associate", func(t *testing.T) {
+		echoAddr := echoUdpServer(t, "127.0.0.1:0")
+		p, err := proxy.Socks5(ctx, socks5.CmdUDPAssociate, "tcp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.WebSocketURL = wsURL
+		conn, err := p.Dial("udp", echoAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		want := "OK"
+		if _, err := conn.Write([]byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 100)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); want != got {
+			t.Fatalf("want %q, but got %q", want, got)
+		}
+	})
+
+	t.Run("connections per ip", func(t *testing.T) {
+		ts := httptest.NewServer(server.New(&server.Config{
+			Limits: server.Limits{
+				MaxConnectionsPerIP: 1,
+				IPv4Prefix:          8,
+			},
+		}).WebSocketHandler())
+		defer ts.Close()
+		p, err := proxy.Socks5(ctx, socks5.CmdConnect, "tcp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.WebSocketURL = "ws" + strings.TrimPrefix(ts.URL, "http")
+
+		conn, err := p.Dial("tcp", echoConnectServer(t, "127.0.0.1:0").Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if conn, err := p.Dial("tcp", echoConnectServer(t, "127.0.0.1:0").Addr().String()); err == nil {
+			conn.Close()
+			t.Fatal("want error, but got nil")
+		}
+	})
+}
+
+func TestSocks5_ProxyProtocol(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	remoteAddrs := make(chan string, 1)
+	socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		TrustedProxies: []*net.IPNet{loopback},
+		Middlewares: []server.Middleware{
+			func(next server.Handler) server.Handler {
+				return server.HandlerFunc(func(ctx context.Context, w server.ResponseWriter, r *server.Request) error {
+					remoteAddrs <- r.RemoteAddr.String()
+					return next.ServeSOCKS(ctx, w, r)
+				})
+			},
+		},
+	})
+	socks5Addr := socks5Ln.Addr()
+
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+	v2 = append(v2, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x04, 0x38)
+	cases := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{
+			name:   "v1",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n"),
+			want:   "192.0.2.1:56324",
+		},
+		{
+			name:   "v2",
+			header: v2,
+			want:   "192.0.2.1:56324",
+		},
+		{
+			name:   "v1 unknown",
+			header: []byte("PROXY UNKNOWN\r\n"),
+			want:   "127.0.0.1",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
+			p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.ProxyDial = func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, err := net.Dial(network, address)
+				if err != nil {
+					return nil, err
+				}
+				if _, err := conn.Write(tc.header); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return conn, nil
+			}
+			conn, err := p.Dial("tcp", echoAddr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if got := <-remoteAddrs; !strings.HasPrefix(got, tc.want) {
+				t.Fatalf("want %s, but got %s", tc.want, got)
+			}
+		})
+	}
+
+	t.Run("no header", func(t *testing.T) {
+		p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := p.Dial("tcp", echoConnectServer(t, "127.0.0.1:0").Addr().String()); err == nil {
+			conn.Close()
+			t.Fatal("want error, but got nil")
+		}
+	})
+
+	t.Run("no header allowed", func(t *testing.T) {
+		socks5Addr := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+			TrustedProxies:          []*net.IPNet{loopback},
+			AllowMissingProxyHeader: true,
+			Middlewares: []server.Middleware{
+				func(next server.Handler) server.Handler {
+					return server.HandlerFunc(func(ctx context.Context, w server.ResponseWriter, r *server.Request) error {
+						remoteAddrs <- r.RemoteAddr.String()
+						return next.ServeSOCKS(ctx, w, r)
+					})
+				},
+			},
+		}).Addr()
+		p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := p.Dial("tcp", echoConnectServer(t, "127.0.0.1:0").Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if got, want := <-remoteAddrs, "127.0.0.1"; !strings.HasPrefix(got, want) {
+			t.Fatalf("want %s, but got %s", want, got)
+		}
+	})
+}
+
+func TestSocks5_ProxyHeaders(t *testing.T) {
+	headers, err := server.NewProxyHeaderTable(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		ProxyHeaders: headers,
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &server.UsernamePassword{
+				Credentials: auth.CredentialStoreFunc(func(username, password string) bool {
+					return username == "alice" && password == "pass"
+				}),
+			},
+		},
+	})
+	socks5Addr := socks5Ln.Addr()
+	p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AuthMethods = map[auth.Method]auth.Authenticator{
+		auth.MethodUsernamePassword: &proxy.UsernamePassword{
+			Username: "alice",
+			Password: "pass",
+		},
+	}
+
+	// header returns the bytes which the backend receives first.
+	header := func(t *testing.T, addr string, n int) []byte {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		received := make(chan []byte, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				received <- nil
+				return
+			}
+			defer conn.Close()
+			b := make([]byte, n)
+			io.ReadFull(conn, b)
+			received <- b
+		}()
+		conn, err := p.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return <-received
+	}
+
+	t.Run("v1", func(t *testing.T) {
+		if err := headers.Reload([]server.ProxyHeaderRule{
+			{Match: "127.0.0.1", Version: server.ProxyHeaderV1},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		got := string(header(t, "127.0.0.1:0", len("PROXY TCP4 127.0.0.1 127.0.0.1")))
+		if want := "PROXY TCP4 127.0.0.1 127.0.0.1"; want != got {
+			t.Fatalf("want %q, but got %q", want, got)
+		}
+	})
+
+	t.Run("v1 mixed families", func(t *testing.T) {
+		if err := headers.Reload([]server.ProxyHeaderRule{
+			{Version: server.ProxyHeaderV1},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		got := string(header(t, "[::1]:0", len("PROXY TCP6 ::ffff:127.0.0.1 ::1")))
+		if want := "PROXY TCP6 ::ffff:127.0.0.1 ::1"; want != got {
+			t.Fatalf("want %q, but got %q", want, got)
+		}
+	})
+
+	t.Run("v2", func(t *testing.T) {
+		if err := headers.Reload([]server.ProxyHeaderRule{
+			{Match: "10.0.0.0/8", Version: server.ProxyHeaderV1},
+			{Version: server.ProxyHeaderV2},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// signature, command, family, length, addresses and the user TLV.
+		got := header(t, "127.0.0.1:0", 12+4+12+3+len("alice"))
+		if want := byte(0x21); got[12] != want {
+			t.Fatalf("want command %#x, but got %#x", want, got[12])
+		}
+		tlv := got[28:]
+		if tlv[0] != server.PP2TypeUser || string(tlv[3:]) != "alice" {
+			t.Fatalf("want user TLV, but got %v", tlv)
+		}
+	})
+
+	t.Run("upstream", func(t *testing.T) {
+		upstreamLn := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+			ProxyHeaders: headers,
+			IPPolicy:     server.PreferIPv4,
+			Upstreams: []server.Upstream{
+				{Address: socks5Server(t, "127.0.0.1:0").Addr().String()},
+			},
+		})
+		if err := headers.Reload([]server.ProxyHeaderRule{
+			{Version: server.ProxyHeaderV1},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		received := make(chan string, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				received <- ""
+				return
+			}
+			defer conn.Close()
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			received <- line
+		}()
+		upstreamAddr := upstreamLn.Addr()
+		p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, upstreamAddr.Network(), upstreamAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		conn, err := p.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// the destination is the backend rather than the upstream proxy.
+		fields := strings.Fields(<-received)
+		if len(fields) != 6 {
+			t.Fatalf("unexpected header: %q", fields)
+		}
+		want := fmt.Sprint(port)
+		if got := fields[5]; want != got {
+			t.Fatalf("want destination port %s, but got %s", want, got)
+		}
+	})
+}
+
+func TestSocks5_Shaper(t *testing.T) {
+	const limit = 64 << 10
+	shaper, err := server.NewShaper(&server.ShaperConfig{
+		PerIP: server.Bandwidth{Download: limit},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		Shaper: shaper,
+	})
+	socks5Addr := socks5Ln.Addr()
+	p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// echo sends 1.5 seconds of data, it takes 0.5 seconds at least
+	// since the bucket holds the tokens of a second.
+	echo := func(t *testing.T) time.Duration {
+		echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
+		conn, err := p.Dial("tcp", echoAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		start := time.Now()
+		written := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(make([]byte, limit*3/2))
+			written <- err
+		}()
+		if _, err := io.ReadFull(conn, make([]byte, limit*3/2)); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-written; err != nil {
+			t.Fatal(err)
+		}
+		if stats := shaper.Stats(); len(stats.IPs) != 1 {
+			t.Fatalf("want throughput of a client, but got %v", stats.IPs)
+		}
+		return time.Since(start)
+	}
+
+	// the limited echo cannot finish earlier than the bucket allows, and
+	// the unlimited one is compared with it rather than a fixed time.
+	limited := echo(t)
+	if limited < 400*time.Millisecond {
+		t.Fatalf("want limited, but it took %v", limited)
+	}
+	if err := shaper.Reload(&server.ShaperConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := echo(t); elapsed >= limited/2 {
+		t.Fatalf("want unlimited, but it took %v while limited took %v", elapsed, limited)
+	}
+}
+
+func TestSocks5_Limits(t *testing.T) {
+	dial := func(t *testing.T, socks5Addr net.Addr) (net.Conn, error) {
+		echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
+		p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Dial("tcp", echoAddr.String())
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		socks5Addr := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+			Limits: server.Limits{MaxSessions: 1},
+		}).Addr()
+		conn, err := dial(t, socks5Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		_, err = dial(t, socks5Addr)
+		var replyErr *socks5.ReplyError
+		if !errors.As(err, &replyErr) || replyErr.Reply != socks5.StatusGeneralServerFailure {
+			t.Fatalf("want %v, but got %v", socks5.StatusGeneralServerFailure, err)
+		}
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		socks5Addr := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+			Limits: server.Limits{
+				MaxSessions:  1,
+				Overflow:     server.QueueOverflow,
+				QueueTimeout: 5 * time.Second,
+			},
+		}).Addr()
+		conn, err := dial(t, socks5Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.AfterFunc(100*time.Millisecond, func() { conn.Close() })
+
+		queued, err := dial(t, socks5Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queued.Close()
+	})
+
+	t.Run("connections per ip", func(t *testing.T) {
+		socks5Addr := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+			Limits: server.Limits{
+				MaxConnectionsPerIP: 1,
+				IPv4Prefix:          8,
+			},
+		}).Addr()
+		conn, err := net.Dial("tcp", socks5Addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// wait for the connection to be accepted by the method negotiation.
+		if _, err := conn.Write([]byte{socks5.Version, 1, byte(auth.MethodNotRequired)}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := dial(t, socks5Addr); err == nil {
+			conn.Close()
+			t.Fatal("want error, but got nil")
+		}
+	})
+}
+
+func TestSocks5_Quota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &server.FileQuotaStore{Path: filepath.Join(dir, "quota.json")}
+	quota, err := server.NewQuota(&server.QuotaConfig{
+		Limit: server.QuotaLimit{Daily: 10},
+		Store: store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		Quota: quota,
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &server.UsernamePassword{
+				Credentials: auth.CredentialStoreFunc(func(username, password string) bool {
+					return password == "pass"
+				}),
+			},
+		},
+	})
+	socks5Addr := socks5Ln.Addr()
+	p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AuthMethods = map[auth.Method]auth.Authenticator{
+		auth.MethodUsernamePassword: &proxy.UsernamePassword{
+			Username: "alice",
+			Password: "pass",
+		},
+	}
+
+	echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
+	conn, err := p.Dial("tcp", echoAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "0123456789"
+	if _, err := conn.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(want))); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// the echoed bytes may be counted after they are read.
+	deadline := time.Now().Add(5 * time.Second)
+	for quota.Usage("alice").DailyBytes != 20 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want 20 bytes, but got %d", quota.Usage("alice").DailyBytes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = p.Dial("tcp", echoConnectServer(t, "127.0.0.1:0").Addr().String())
+	var replyErr *socks5.ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Reply != socks5.StatusNotAllowedByRuleSet {
+		t.Fatalf("want %v, but got %v", socks5.StatusNotAllowedByRuleSet, err)
+	}
+
+	t.Run("bind", func(t *testing.T) {
+		conn, err := net.Dial("tcp", socks5Addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr().(*net.TCPAddr)
+		req := []byte{socks5.Version, 1, byte(auth.MethodUsernamePassword)}
+		req = append(req, auth.UsernamePasswordVersion, 3, 'b', 'o', 'b', 4, 'p', 'a', 's', 's')
+		req = append(req, socks5.Version, byte(socks5.CmdBind), 0, byte(address.TypeIPv4), 127, 0, 0, 1)
+		req = append(req, byte(echoAddr.Port>>8), byte(echoAddr.Port))
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		// method selection, username/password status and the reply.
+		resp := make([]byte, 2+2+10)
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp[3] != 0 || socks5.Reply(resp[5]) != socks5.StatusSucceeded {
+			t.Fatalf("unexpected response: %v", resp)
+		}
+		peer, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", int(resp[12])<<8|int(resp[13])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		if _, err := peer.Write([]byte("01234")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(peer, make([]byte, 5)); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for quota.Usage("bob").DailyBytes != 10 {
+			if time.Now().After(deadline) {
+				t.Fatalf("want 10 bytes, but got %d", quota.Usage("bob").DailyBytes)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	if err := quota.Close(); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := usage["alice"].MonthlyBytes; got != 20 {
+		t.Fatalf("want 20 bytes saved, but got %d", got)
+	}
+}
+
+func TestSocks5_AuthGuard(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		bans []server.Ban
+	)
+	guard := server.NewAuthGuard(&server.AuthGuardConfig{
+		MaxFailures: 2,
+		BaseDelay:   time.Millisecond,
+		BanDuration: time.Minute,
+		OnBan: func(ban server.Ban) {
+			mu.Lock()
+			bans = append(bans, ban)
+			mu.Unlock()
+		},
+	})
+	authMethods := func() map[auth.Method]auth.Authenticator {
+		return map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &server.UsernamePassword{
+				Credentials: auth.CredentialStoreFunc(func(username, password string) bool {
+					return password == "pass"
+				}),
+			},
+		}
+	}
+	socks5Addr := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		AuthGuard:   guard,
+		AuthMethods: authMethods(),
+	}).Addr()
+	dial := func(socks5Addr net.Addr, username, password string) error {
+		conn, err := dialEcho(t, socks5Addr, map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &proxy.UsernamePassword{
+				Username: username,
+				Password: password,
+			},
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := dial(socks5Addr, "alice", "wrong"); err == nil {
+			t.Fatal("want error with wrong password")
+		}
+	}
+	mu.Lock()
+	if len(bans) != 2 {
+		t.Fatalf("want 2 ban events, but got %v", bans)
+	}
+	mu.Unlock()
+	if got := guard.Bans(); len(got) != 2 {
+		t.Fatalf("want client and user banned, but got %v", got)
+	}
+	if err := dial(socks5Addr, "alice", "pass"); err == nil {
+		t.Fatal("want error from banned client")
+	}
+
+	if !guard.UnbanIP("127.0.0.1") {
+		t.Fatal("want client to be unbanned")
+	}
+	if err := dial(socks5Addr, "alice", "pass"); err == nil {
+		t.Fatal("want error from banned user")
+	}
+
+	if !guard.UnbanUser("alice") {
+		t.Fatal("want user to be unbanned")
+	}
+	if err := dial(socks5Addr, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if got := guard.Bans(); len(got) != 0 {
+		t.Fatalf("want no bans, but got %v", got)
+	}
+
+	// the failures of bob are forgotten to track carol.
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	socks5Addr = socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		AuthGuard: server.NewAuthGuard(&server.AuthGuardConfig{
+			MaxFailures: 2,
+			BaseDelay:   time.Millisecond,
+			MaxTracked:  1,
+			Allowlist:   []*net.IPNet{loopback},
+		}),
+		AuthMethods: authMethods(),
+	}).Addr()
+	for _, user := range []string{"bob", "carol", "bob"} {
+		if err := dial(socks5Addr, user, "wrong"); err == nil {
+			t.Fatal("want error with wrong password")
+		}
+	}
+	if err := dial(socks5Addr, "bob", "pass"); err != nil {
+		t.Fatalf("want bob not banned, but got %v", err)
+	}
+
+	// the failures of a user are delayed even from allowed clients.
+	const baseDelay = 100 * time.Millisecond
+	socks5Addr = socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		AuthGuard: server.NewAuthGuard(&server.AuthGuardConfig{
+			MaxFailures: 10,
+			BaseDelay:   baseDelay,
+			Allowlist:   []*net.IPNet{loopback},
+		}),
+		AuthMethods: authMethods(),
+	}).Addr()
+	for i, want := range []time.Duration{baseDelay, 2 * baseDelay} {
+		start := time.Now()
+		if err := dial(socks5Addr, "dave", "wrong"); err == nil {
+			t.Fatal("want error with wrong password")
+		}
+		if elapsed := time.Since(start); elapsed < want {
+			t.Fatalf("want failure %d delayed %v, but it took %v", i+1, want, elapsed)
+		}
+	}
+}
+
+func TestSocks5_CredentialStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bcryptHash := func(password string) string {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(hash)
+	}
+	htpasswd := filepath.Join(dir, ".htpasswd")
+	writeFile := func(path, content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	writeFile(htpasswd, "alice:"+bcryptHash("pass")+"\n"+
+		"bob:{SHA}nU4eI71bcnBGqeO0t9tXvY1u5oQ=\n", now) // "pass"
+	htpasswdStore, err := auth.NewHtpasswdStore(htpasswd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userFile := filepath.Join(dir, "users.yaml")
+	writeFile(userFile, "users:\n"+
+		"  - name: alice\n"+
+		"    password: pass\n"+
+		"    attributes:\n"+
+		"      group: admin\n", now)
+	userFileStore, err := auth.NewUserFileStore(userFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonFile := filepath.Join(dir, "users.json")
+	writeFile(jsonFile, `{"users":[{"name":"bob","password":"{SHA}nU4eI71bcnBGqeO0t9tXvY1u5oQ="}]}`, now)
+	jsonFileStore, err := auth.NewUserFileStore(jsonFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func(store auth.CredentialStore, username, password string) (*auth.Identity, error) {
+		socks5Addr, identities := identityServer(t, &server.Config{
+			AuthMethods: map[auth.Method]auth.Authenticator{
+				auth.MethodUsernamePassword: &server.UsernamePassword{
+					Credentials: store,
+				},
+			},
+		})
+		conn, err := dialEcho(t, socks5Addr, map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &proxy.UsernamePassword{
+				Username: username,
+				Password: password,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		conn.Close()
+		return <-identities, nil
+	}
+
+	cases := []struct {
+		name     string
+		store    auth.CredentialStore
+		username string
+		password string
+		wantErr  bool
+	}{
+		{"memory", auth.NewMemoryStore(map[string]string{"alice": "pass"}), "alice", "pass", false},
+		{"memory wrong password", auth.NewMemoryStore(map[string]string{"alice": "pass"}), "alice", "wrong", true},
+		{"memory unknown user", auth.NewMemoryStore(map[string]string{"alice": "pass"}), "bob", "pass", true},
+		{"memory unknown hash", auth.NewMemoryStore(map[string]string{"alice": "$6$salt$hash"}), "alice", "$6$salt$hash", true},
+		{"htpasswd bcrypt", htpasswdStore, "alice", "pass", false},
+		{"htpasswd sha", htpasswdStore, "bob", "pass", false},
+		{"htpasswd wrong password", htpasswdStore, "bob", "wrong", true},
+		{"user file", userFileStore, "alice", "pass", false},
+		{"json user file", jsonFileStore, "bob", "pass", false},
+		{"json user file wrong password", jsonFileStore, "bob", "wrong", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := dial(tc.store, tc.username, tc.password)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("want error %v, but got %v", tc.wantErr, err)
+			}
+		})
+	}
+
+	t.Run("user file unknown hash", func(t *testing.T) {
+		path := filepath.Join(dir, "unknown.yaml")
+		writeFile(path, "users:\n"+
+			"  - name: alice\n"+
+			"    password: $apr1$salt$hash\n", now)
+		if _, err := auth.NewUserFileStore(path); err == nil {
+			t.Fatal("want error, but got nil")
+		}
+	})
+
+	t.Run("attributes", func(t *testing.T) {
+		id, err := dial(userFileStore, "alice", "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := id.Attributes["group"]; got != "admin" {
+			t.Fatalf("want admin, but got %v", got)
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		writeFile(htpasswd, "alice:"+bcryptHash("changed")+"\n", now.Add(time.Second))
+		if _, err := dial(htpasswdStore, "alice", "pass"); err == nil {
+			t.Fatal("want error with old password")
+		}
+		if _, err := dial(htpasswdStore, "alice", "changed"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("reload user file", func(t *testing.T) {
+		writeFile(userFile, "users:\n"+
+			"  - name: alice\n"+
+			"    password: changed\n", now.Add(time.Second))
+		if _, err := dial(userFileStore, "alice", "pass"); err == nil {
+			t.Fatal("want error with old password")
+		}
+		id, err := dial(userFileStore, "alice", "changed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id.Attributes != nil {
+			t.Fatalf("want no attributes, but got %v", id.Attributes)
+		}
+	})
+
+	t.Run("invalid reload", func(t *testing.T) {
+		writeFile(htpasswd, "alice:$6$salt$hash\n", now.Add(2*time.Second))
+		if _, err := dial(htpasswdStore, "alice", "changed"); err != nil {
+			t.Fatalf("want the previous users kept, but got %v", err)
+		}
+		writeFile(jsonFile, `{"users":`, now.Add(time.Second))
+		if _, err := dial(jsonFileStore, "bob", "pass"); err != nil {
+			t.Fatalf("want the previous users kept, but got %v", err)
+		}
+	})
 }
 
-func TestSocks5_Bind(t *testing.T) {
-	for _, address := range addressCase {
-		t.Run(address, func(t *testing.T) {
-			socks5Ln := socks5Server(t, address)
-			ctx := context.Background()
-			socks5Addr := socks5Ln.Addr()
+func TestSocks5_HMACSHA256(t *testing.T) {
+	socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodHMACSHA256: &server.HMACSHA256{
+				Keys: auth.KeyStoreFunc(func(username string) ([]byte, bool) {
+					if username != "alice" {
+						return nil, false
+					}
+					return []byte("secret"), true
+				}),
+			},
+		},
+	})
+	socks5Addr := socks5Ln.Addr()
+	echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
 
-			dialer, err := proxy.Socks5(ctx, socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+	cases := []struct {
+		name     string
+		username string
+		key      string
+		wantErr  bool
+	}{
+		{"valid", "alice", "secret", false},
+		{"wrong key", "alice", "wrong", true},
+		{"unknown user", "bob", "secret", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
 			if err != nil {
 				t.Fatal(err)
 			}
+			p.AuthMethods = map[auth.Method]auth.Authenticator{
+				auth.MethodHMACSHA256: &proxy.HMACSHA256{
+					Username: tc.username,
+					Key:      []byte(tc.key),
+				},
+			}
+			conn, err := p.Dial("tcp", echoAddr.String())
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("want error %v, but got %v", tc.wantErr, err)
+			}
+			if err == nil {
+				conn.Close()
+			}
+		})
+	}
+}
 
-			echoLn, waitCh := echoBindServer(t, address)
-			echoAddr := echoLn.Addr()
-			conn1, err := dialer.Dial(echoAddr.Network(), echoAddr.String())
+func TestSocks5_JWT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	jwks := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(jwks, []byte(fmt.Sprintf(
+		`{"keys":[{"kty":"EC","kid":"ec","crv":"P-256","x":%q,"y":%q}]}`,
+		encode(ecKey.X.Bytes()), encode(ecKey.Y.Bytes()),
+	)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hmacKey := []byte("secret")
+	sign := func(alg string, claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+		payload, _ := json.Marshal(claims)
+		signed := encode(header) + "." + encode(payload)
+		digest := sha256.Sum256([]byte(signed))
+		var sig []byte
+		switch alg {
+		case "HS256":
+			mac := hmac.New(sha256.New, hmacKey)
+			mac.Write([]byte(signed))
+			sig = mac.Sum(nil)
+		case "ES256":
+			r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
 			if err != nil {
 				t.Fatal(err)
 			}
-			defer conn1.Close()
+			sig = make([]byte, 64)
+			rb, sb := r.Bytes(), s.Bytes()
+			copy(sig[32-len(rb):32], rb)
+			copy(sig[64-len(sb):], sb)
+		}
+		return signed + "." + encode(sig)
+	}
 
-			dialer2, err := proxy.Socks5(ctx, socks5.CmdBind, socks5Addr.Network(), socks5Addr.String())
+	config := &server.JWTConfig{
+		HMACKey:  hmacKey,
+		JWKSFile: jwks,
+		Audience: "socks5",
+	}
+	verifier, err := server.NewJWTVerifier(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.UserClaim != "" {
+		t.Fatalf("want the config unchanged, but UserClaim is %q", config.UserClaim)
+	}
+	socks5Addr, identities := identityServer(t, &server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodJWT: &server.JWT{Verifier: verifier},
+			auth.MethodUsernamePassword: &server.JWT{
+				Verifier:      verifier,
+				PasswordField: true,
+			},
+		},
+	})
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	cases := []struct {
+		name          string
+		method        auth.Method
+		token         string
+		passwordField bool
+		wantErr       bool
+	}{
+		{
+			name:   "hmac",
+			method: auth.MethodJWT,
+			token:  sign("HS256", map[string]interface{}{"sub": "alice", "aud": "socks5", "exp": exp}),
+		},
+		{
+			name:          "jwks in password",
+			method:        auth.MethodUsernamePassword,
+			token:         sign("ES256", map[string]interface{}{"sub": "alice", "aud": []string{"socks5"}, "exp": exp}),
+			passwordField: true,
+		},
+		{
+			name:    "expired",
+			method:  auth.MethodJWT,
+			token:   sign("HS256", map[string]interface{}{"sub": "alice", "aud": "socks5", "exp": exp - 7200}),
+			wantErr: true,
+		},
+		{
+			name:    "wrong audience",
+			method:  auth.MethodJWT,
+			token:   sign("ES256", map[string]interface{}{"sub": "alice", "aud": "other", "exp": exp}),
+			wantErr: true,
+		},
+		{
+			name:    "tampered",
+			method:  auth.MethodJWT,
+			token:   sign("HS256", map[string]interface{}{"sub": "alice", "aud": "socks5", "exp": exp}) + "A",
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := dialEcho(t, socks5Addr, map[auth.Method]auth.Authenticator{
+				tc.method: &proxy.JWT{
+					Token:         tc.token,
+					PasswordField: tc.passwordField,
+				},
+			})
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("want error %v, but got %v", tc.wantErr, err)
+			}
 			if err != nil {
-				t.Fatal(err)
+				return
 			}
+			conn.Close()
+			id := <-identities
+			if id.User != "alice" || id.Attributes["sub"] != "alice" {
+				t.Fatalf("unexpected identity: %+v", id)
+			}
+		})
+	}
+}
 
-			ln, err := dialer2.Listen("tcp", address)
-			if err != nil {
-				t.Fatal(err)
+func TestSocks5_GSSAPI(t *testing.T) {
+	type gssServer struct {
+		addr       net.Addr
+		identities chan *auth.Identity
+	}
+	servers := make(map[auth.GSSProtectionLevel]gssServer)
+	for _, protection := range []auth.GSSProtectionLevel{0, auth.GSSIntegrity, auth.GSSConfidentiality} {
+		addr, identities := identityServer(t, &server.Config{
+			AuthMethods: map[auth.Method]auth.Authenticator{
+				auth.MethodGSSAPI: &server.GSSAPI{
+					Mechanism:  &fakeGSSMechanism{key: 0x5a, name: "proxy"},
+					Protection: protection,
+				},
+			},
+		})
+		servers[protection] = gssServer{addr, identities}
+	}
+	methods := func(key byte, protection auth.GSSProtectionLevel, confidential *int32) map[auth.Method]auth.Authenticator {
+		return map[auth.Method]auth.Authenticator{
+			auth.MethodGSSAPI: &proxy.GSSAPI{
+				Mechanism:  &fakeGSSMechanism{key: key, name: "alice@EXAMPLE.COM", confidential: confidential},
+				Target:     "proxy",
+				Protection: protection,
+			},
+		}
+	}
+
+	cases := []struct {
+		name             string
+		key              byte
+		server           auth.GSSProtectionLevel // Protection of the server
+		protection       auth.GSSProtectionLevel // requested by the client
+		wantErr          bool
+		wantConfidential bool
+	}{
+		{"integrity", 0x5a, 0, auth.GSSIntegrity, false, false},
+		{"confidentiality", 0x5a, 0, auth.GSSConfidentiality, false, true},
+		{"wrong key", 0x00, 0, auth.GSSConfidentiality, true, false},
+		{"server protection", 0x5a, auth.GSSConfidentiality, auth.GSSIntegrity, false, true},
+		{"downgrade", 0x5a, auth.GSSIntegrity, auth.GSSConfidentiality, true, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var confidential int32
+			s := servers[tc.server]
+			conn, err := dialEcho(t, s.addr, methods(tc.key, tc.protection, &confidential))
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("want error %v, but got %v", tc.wantErr, err)
 			}
-			addr := ln.Addr()
-			_, err = conn1.Write([]byte(addr.String() + "\n"))
 			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if id := <-s.identities; id.User != "alice@EXAMPLE.COM" {
+				t.Fatalf("unexpected identity: %+v", id)
+			}
+
+			want := strings.Repeat("encapsulated", 10000)
+			go conn.Write([]byte(want))
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, got); err != nil {
 				t.Fatal(err)
 			}
+			if want != string(got) {
+				t.Fatal("unexpected echo")
+			}
+			if got := atomic.LoadInt32(&confidential) > 0; tc.wantConfidential != got {
+				t.Fatalf("want confidential %v, but got %v", tc.wantConfidential, got)
+			}
+		})
+	}
 
-			// wait to dial tcp from echo bind server
-			<-waitCh
+	t.Run("udp associate", func(t *testing.T) {
+		var confidential int32
+		s := servers[0]
+		p, err := proxy.Socks5(context.Background(), socks5.CmdUDPAssociate, s.addr.Network(), s.addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.AuthMethods = methods(0x5a, auth.GSSConfidentiality, &confidential)
+		conn, err := p.Dial("udp", echoUdpServer(t, "127.0.0.1:0").String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		<-s.identities
+		before := atomic.LoadInt32(&confidential)
 
-			want := "OK"
-			_, err = conn1.Write([]byte(want))
+		want := "OK"
+		if _, err := conn.Write([]byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 100)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); want != got {
+			t.Fatalf("want %s, but got %s", want, got)
+		}
+		if atomic.LoadInt32(&confidential) == before {
+			t.Fatal("want the datagram to be encapsulated")
+		}
+	})
+
+	t.Run("client certificate", func(t *testing.T) {
+		serverCert, clientCert, pool := certificates(t)
+		socks5Ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities := make(chan *auth.Identity, 1)
+		s := server.New(&server.Config{
+			Middlewares: []server.Middleware{captureIdentity(identities)},
+			AuthMethods: map[auth.Method]auth.Authenticator{
+				auth.MethodGSSAPI: &server.ClientCertificate{
+					Next: &server.GSSAPI{
+						Mechanism: &fakeGSSMechanism{key: 0x5a, name: "proxy"},
+					},
+				},
+			},
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{serverCert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    pool,
+			},
+		})
+		go s.ServeTLS(socks5Ln, "", "")
+
+		var confidential int32
+		socks5Addr := socks5Ln.Addr()
+		p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.AuthMethods = methods(0x5a, auth.GSSConfidentiality, &confidential)
+		p.TLSConfig = &tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{clientCert},
+		}
+		echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
+		conn, err := p.Dial("tcp", echoAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if id := <-identities; id.User != "alice@EXAMPLE.COM" || id.Certificate == nil {
+			t.Fatalf("unexpected identity: %+v", id)
+		}
+
+		want := "hello"
+		if _, err := conn.Write([]byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if want != string(got) {
+			t.Fatalf("want %q, but got %q", want, got)
+		}
+		if atomic.LoadInt32(&confidential) == 0 {
+			t.Fatal("want the connection to be encapsulated")
+		}
+	})
+}
+
+// fakeGSSMechanism establishes the context with the shared key, which
+// needs no KDC. The messages are protected by the checksum and encrypted
+// by XOR with the key. The messages wrapped with confidentiality are
+// counted by confidential if not nil.
+type fakeGSSMechanism struct {
+	key          byte
+	name         string
+	confidential *int32
+}
+
+func (m *fakeGSSMechanism) AcceptContext() (auth.GSSContext, error) {
+	return &fakeGSSContext{key: m.key, name: m.name, confidential: m.confidential}, nil
+}
+
+func (m *fakeGSSMechanism) InitContext(target string) (auth.GSSContext, error) {
+	return &fakeGSSContext{key: m.key, name: m.name, target: target, initiator: true, confidential: m.confidential}, nil
+}
+
+type fakeGSSContext struct {
+	key          byte
+	name         string
+	target       string
+	peer         string
+	initiator    bool
+	confidential *int32
+}
+
+func (c *fakeGSSContext) Step(token []byte) ([]byte, bool, error) {
+	if c.initiator {
+		if token == nil {
+			return []byte(fmt.Sprintf("AP-REQ:%c:%s:%s", c.key, c.target, c.name)), false, nil
+		}
+		if string(token) != "AP-REP" {
+			return nil, false, fmt.Errorf("unexpected token %q", token)
+		}
+		c.peer = c.target
+		return nil, true, nil
+	}
+	parts := strings.SplitN(string(token), ":", 4)
+	if len(parts) != 4 || parts[0] != "AP-REQ" || parts[1] != string([]byte{c.key}) || parts[2] != c.name {
+		return nil, false, errors.New("invalid AP-REQ")
+	}
+	c.peer = parts[3]
+	return []byte("AP-REP"), true, nil
+}
+
+func (c *fakeGSSContext) Wrap(msg []byte, confidential bool) ([]byte, error) {
+	token := make([]byte, 0, len(msg)+2)
+	var sum byte
+	for _, b := range msg {
+		sum += b
+		if confidential {
+			b ^= c.key
+		}
+		token = append(token, b)
+	}
+	flag := byte(0)
+	if confidential {
+		flag = 1
+		if c.confidential != nil {
+			atomic.AddInt32(c.confidential, 1)
+		}
+	}
+	return append(token, flag, sum^c.key), nil
+}
+
+func (c *fakeGSSContext) Unwrap(token []byte) ([]byte, error) {
+	if len(token) < 2 {
+		return nil, errors.New("too short token")
+	}
+	msg, flag, want := token[:len(token)-2], token[len(token)-2], token[len(token)-1]^c.key
+	var sum byte
+	for i := range msg {
+		if flag == 1 {
+			msg[i] ^= c.key
+		}
+		sum += msg[i]
+	}
+	if sum != want {
+		return nil, errors.New("checksum mismatch")
+	}
+	return msg, nil
+}
+
+func (c *fakeGSSContext) PeerName() string {
+	return c.peer
+}
+
+func TestSocks5_AuthPolicy(t *testing.T) {
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	methods := func() map[auth.Method]auth.Authenticator {
+		return map[auth.Method]auth.Authenticator{
+			auth.MethodNotRequired: &server.NotRequired{},
+			auth.MethodUsernamePassword: &server.UsernamePassword{
+				Credentials: auth.NewMemoryStore(map[string]string{"alice": "pass"}),
+			},
+		}
+	}
+	clientMethods := map[auth.Method]auth.Authenticator{
+		auth.MethodNotRequired: &proxy.NotRequired{},
+		auth.MethodUsernamePassword: &proxy.UsernamePassword{
+			Username: "alice",
+			Password: "pass",
+		},
+	}
+
+	cases := []struct {
+		name      string
+		policy    server.AuthPolicy
+		authOrder []auth.Method
+		wantUser  string
+		wantErr   bool
+	}{
+		{
+			name:      "client preferred",
+			authOrder: []auth.Method{auth.MethodUsernamePassword, auth.MethodNotRequired},
+			wantUser:  "alice",
+		},
+		{
+			name:     "client default order",
+			wantUser: "",
+		},
+		{
+			name: "server preferred",
+			policy: server.AuthPolicy{
+				Preference: server.ServerPreferred,
+				Order:      []auth.Method{auth.MethodUsernamePassword},
+			},
+			wantUser: "alice",
+		},
+		{
+			name: "required",
+			policy: server.AuthPolicy{
+				Required: []server.MethodRequirement{
+					{Network: loopback, Methods: []auth.Method{auth.MethodUsernamePassword}},
+				},
+			},
+			wantUser: "alice",
+		},
+		{
+			name: "required but not offered",
+			policy: server.AuthPolicy{
+				Required: []server.MethodRequirement{
+					{Network: loopback, Methods: []auth.Method{auth.MethodGSSAPI}},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			identities := make(chan *auth.Identity, 1)
+			socks5Ln := socks5ServerWithConfig(t, "127.0.0.1:0", &server.Config{
+				AuthMethods: methods(),
+				AuthPolicy:  tc.policy,
+				Middlewares: []server.Middleware{
+					func(next server.Handler) server.Handler {
+						return server.HandlerFunc(func(ctx context.Context, w server.ResponseWriter, r *server.Request) error {
+							identities <- r.Identity
+							return next.ServeSOCKS(ctx, w, r)
+						})
+					},
+				},
+			})
+			socks5Addr := socks5Ln.Addr()
+			p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
 			if err != nil {
 				t.Fatal(err)
 			}
+			p.AuthMethods = clientMethods
+			p.AuthOrder = tc.authOrder
 
-			conn2, err := ln.Accept()
+			echoAddr := echoConnectServer(t, "127.0.0.1:0").Addr()
+			conn, err := p.Dial("tcp", echoAddr.String())
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("want error %v, but got %v", tc.wantErr, err)
+			}
 			if err != nil {
-				t.Fatal(err)
+				return
 			}
-			defer conn2.Close()
-
-			buf := make([]byte, 2)
-			if _, err := conn2.Read(buf); err != nil {
-				t.Fatal(err)
+			conn.Close()
+			var user string
+			if id := <-identities; id != nil {
+				user = id.User
 			}
-			got := string(buf)
-			if want != got {
-				t.Fatalf("want %s, but got %s", want, got)
+			if user != tc.wantUser {
+				t.Fatalf("want user %q, but got %q", tc.wantUser, user)
 			}
 		})
 	}
+
+	t.Run("required but unknown address", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "authpolicy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		socks5Ln, err := net.Listen("unix", filepath.Join(dir, "socks5.sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer socks5Ln.Close()
+		go server.New(&server.Config{
+			AuthMethods: methods(),
+			AuthPolicy: server.AuthPolicy{
+				Required: []server.MethodRequirement{
+					{Network: loopback, Methods: []auth.Method{auth.MethodUsernamePassword}},
+				},
+			},
+		}).Serve(socks5Ln)
+
+		socks5Addr := socks5Ln.Addr()
+		p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.AuthMethods = map[auth.Method]auth.Authenticator{
+			auth.MethodNotRequired: &proxy.NotRequired{},
+		}
+		if conn, err := p.Dial("tcp", echoConnectServer(t, "127.0.0.1:0").Addr().String()); err == nil {
+			conn.Close()
+			t.Fatal("want error, but got nil")
+		}
+	})
 }
 
 func socks5Server(t *testing.T, address string) net.Listener {
+	t.Helper()
+	return socks5ServerWithConfig(t, address, nil)
+}
+
+func socks5ServerWithConfig(t *testing.T, address string, c *server.Config) net.Listener {
 	t.Helper()
 	socks5Ln, err := net.Listen("tcp", address)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	go func() {
-		if err := server.New(nil).Serve(socks5Ln); err != nil {
+		if err := server.New(c).Serve(socks5Ln); err != nil {
 			panic(err)
 		}
 	}()
 	return socks5Ln
 }
 
+// identityServer starts the server by c, and returns its address and the
+// channel which receives the identity of each request.
+func identityServer(t *testing.T, c *server.Config) (net.Addr, chan *auth.Identity) {
+	t.Helper()
+	identities := make(chan *auth.Identity, 1)
+	c.Middlewares = append(c.Middlewares, captureIdentity(identities))
+	return socks5ServerWithConfig(t, "127.0.0.1:0", c).Addr(), identities
+}
+
+// captureIdentity returns the middleware which sends the identity of each
+// request to identities.
+func captureIdentity(identities chan<- *auth.Identity) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return server.HandlerFunc(func(ctx context.Context, w server.ResponseWriter, r *server.Request) error {
+			identities <- r.Identity
+			return next.ServeSOCKS(ctx, w, r)
+		})
+	}
+}
+
+// dialEcho connects to a new echo server through the server at addr,
+// authenticated by the methods.
+func dialEcho(t *testing.T, addr net.Addr, methods map[auth.Method]auth.Authenticator) (net.Conn, error) {
+	t.Helper()
+	p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, addr.Network(), addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AuthMethods = methods
+	conn, err := p.Dial("tcp", echoConnectServer(t, "127.0.0.1:0").Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
 func echoConnectServer(t *testing.T, address string) net.Listener {
 	t.Helper()
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
@@ -252,3 +2970,150 @@ func echoUdpServer(t *testing.T, address string) net.Addr {
 	}()
 	return conn.LocalAddr()
 }
+
+// sshServer starts the SSH server which accepts "user:pass" and
+// direct-tcpip channels. disconnect closes all client connections.
+func sshServer(t *testing.T) (addr string, hostKey ssh.PublicKey, disconnect func()) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(pass) == "pass" {
+				return nil, nil
+			}
+			return nil, errors.New("permission denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newCh := range chans {
+					var payload struct {
+						Host       string
+						Port       uint32
+						OriginHost string
+						OriginPort uint32
+					}
+					if err := ssh.Unmarshal(newCh.ExtraData(), &payload); err != nil {
+						newCh.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port)))
+					if err != nil {
+						newCh.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					ch, reqs, err := newCh.Accept()
+					if err != nil {
+						target.Close()
+						continue
+					}
+					go ssh.DiscardRequests(reqs)
+					go func() {
+						defer ch.Close()
+						defer target.Close()
+						go func() {
+							io.Copy(target, ch)
+							target.(*net.TCPConn).CloseWrite()
+						}()
+						io.Copy(ch, target)
+					}()
+				}
+			}()
+		}
+	}()
+	disconnect = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		conns = nil
+	}
+	return ln.Addr().String(), signer.PublicKey(), disconnect
+}
+
+// certificates returns the certificates of server and client "alice"
+// issued by the CA in the pool.
+func certificates(t *testing.T) (serverCert, clientCert tls.Certificate, pool *x509.CertPool) {
+	t.Helper()
+	issue := func(template, parent *x509.Certificate, parentKey crypto.Signer) (tls.Certificate, *x509.Certificate) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+			Leaf:        cert,
+		}, cert
+	}
+
+	ca, caCert := issue(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	serverCert, _ = issue(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, ca.PrivateKey.(crypto.Signer))
+	clientCert, _ = issue(&x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "alice"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, ca.PrivateKey.(crypto.Signer))
+
+	pool = x509.NewCertPool()
+	pool.AddCert(caCert)
+	return serverCert, clientCert, pool
+}